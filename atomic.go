@@ -0,0 +1,10 @@
+//go:build go1.23
+
+package bloom
+
+import "sync/atomic"
+
+// atomicOr sets the mask bits of the bucket with atomic OR.
+func atomicOr(bucket *uint64, mask uint64) {
+	atomic.OrUint64(bucket, mask)
+}
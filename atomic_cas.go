@@ -0,0 +1,16 @@
+//go:build !go1.23
+
+package bloom
+
+import "sync/atomic"
+
+// atomicOr sets the mask bits of the bucket with a compare-and-swap loop,
+// since atomic.OrUint64 is only available since Go 1.23.
+func atomicOr(bucket *uint64, mask uint64) {
+	for {
+		old := atomic.LoadUint64(bucket)
+		if old&mask == mask || atomic.CompareAndSwapUint64(bucket, old, old|mask) {
+			return
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package bloom
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func BenchmarkFilter_Add(b *testing.B) {
 	tt := []struct {
 		name string
-		n    uint32
+		n    uint64
 		prob float64
 	}{
 		{"1.198MB", 1000000, 0.01},
@@ -29,7 +35,7 @@ func BenchmarkFilter_Add(b *testing.B) {
 func BenchmarkFilter_Has(b *testing.B) {
 	tt := []struct {
 		name string
-		n    uint32
+		n    uint64
 		prob float64
 	}{
 		{"1.198MB", 1000000, 0.01},
@@ -49,3 +55,196 @@ func BenchmarkFilter_Has(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkFilter_PrecomputePositions(b *testing.B) {
+	bf, err := New(2147483647, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = []byte(fmt.Sprintf("Hello, 世界 🤪 %d", i))
+	}
+
+	b.Run("interleaved", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, e := range elements {
+				bf.Add(e)
+			}
+		}
+	})
+	b.Run("two-phase", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			positions, _ := bf.PrecomputePositions(elements)
+			bf.AddPositions(positions)
+		}
+	})
+}
+
+func BenchmarkParallelUnion(b *testing.B) {
+	filters := make([]*Filter, 100)
+	for i := range filters {
+		bf, err := New(1000000, 0.01)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bf.Add([]byte(fmt.Sprintf("Hello, 世界 🤪 %d", i)))
+		filters[i] = bf
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ParallelUnion(1, filters...)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ParallelUnion(runtime.NumCPU(), filters...)
+		}
+	})
+}
+
+// FillTo adds elements produced by gen until the fill ratio of the filter reaches targetRatio.
+// It's a benchmark helper to query a realistically loaded filter.
+// targetRatio must be in (0, 1) since a filter can't be filled completely.
+func (bf *Filter) FillTo(targetRatio float64, gen func(i int) []byte) error {
+	if !(targetRatio > 0 && targetRatio < 1) {
+		return fmt.Errorf("fill ratio %v must be in (0, 1)", targetRatio)
+	}
+	var i int
+	for {
+		setbits := bf.SetBits()
+		if float64(setbits)/float64(bf.bitlen) >= targetRatio {
+			return nil
+		}
+		// The number of elements to reach the target is estimated
+		// to avoid counting set bits after every added element.
+		want := -float64(bf.bitlen) / float64(bf.hashqty) * math.Log(1-targetRatio)
+		adds := int(want-estimateCount(setbits, bf.hashqty, bf.bitlen)) + 1
+		for end := i + adds; i < end; i++ {
+			bf.Add(gen(i))
+		}
+	}
+}
+
+func TestFilter_FillTo(t *testing.T) {
+	gen := func(i int) []byte {
+		return []byte(fmt.Sprintf("element%d", i))
+	}
+	for _, ratio := range []float64{0, 1, 1.5, -0.5, math.NaN()} {
+		bf, err := New(100, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bf.FillTo(ratio, gen); err == nil {
+			t.Errorf("FillTo(%v) error is nil", ratio)
+		}
+	}
+
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bf.FillTo(0.5, gen); err != nil {
+		t.Fatal(err)
+	}
+	if got := float64(bf.SetBits()) / float64(bf.bitlen); got < 0.5 || got > 0.55 {
+		t.Errorf("FillTo(0.5) fill ratio = %f, want in [0.5, 0.55]", got)
+	}
+}
+
+func BenchmarkFilter_Has_Loaded(b *testing.B) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = bf.FillTo(0.5, func(i int) []byte {
+		return []byte(fmt.Sprintf("element%d", i))
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Has([]byte("Hello, 世界 🤪"))
+	}
+}
+
+func BenchmarkFilter_Add_allocs(b *testing.B) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	element := []byte("Hello, 世界 🤪")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Add(element)
+	}
+}
+
+func BenchmarkPositions(b *testing.B) {
+	tt := []struct {
+		name string
+		opts []Option
+	}{
+		{"sha256 per hash", nil},
+		{"double hashing", []Option{WithDoubleHashing()}},
+		{"wide hashing", []Option{WithWideHashing()}},
+	}
+
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			bf, err := New(1000000, 0.01, tc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			element := []byte("Hello, 世界 🤪")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bf.positions(element, bf.hashqty)
+			}
+		})
+	}
+}
+
+func BenchmarkFilter_Add_short(b *testing.B) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	element := []byte("a")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Add(element)
+	}
+}
+
+func BenchmarkFilter_Add_long(b *testing.B) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	element := []byte(strings.Repeat("Hello, 世界 🤪", 10))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Add(element)
+	}
+}
+
+func BenchmarkScalableFilter_Add_duplicates(b *testing.B) {
+	sf, err := NewScalable(1000000, 0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000000; i++ {
+		sf.Add([]byte("Hello, 世界 🤪"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sf.Add([]byte("Hello, 世界 🤪"))
+	}
+}
@@ -5,18 +5,28 @@
 // the larger the probability of false positives.
 //
 // A Bloom filter of a fixed size can represent a set with an arbitrarily large number of elements
-// (4,294,967,295 in this implementation); adding an element never fails due to the data structure "filling up".
+// (18,446,744,073,709,551,615 in this implementation as long as the bit array fits into memory);
+// adding an element never fails due to the data structure "filling up".
 package bloom
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
 	"math"
+	"math/bits"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // Filter represents a Bloom filter.
-// Note, operations are not concurrency safe.
+// Note, operations are not concurrency safe, see SafeFilter.
 type Filter struct {
 	// prob is a desired probability of false positives.
 	prob float64
@@ -25,19 +35,84 @@ type Filter struct {
 	// hashqty is a number of hash functions.
 	hashqty byte
 	// n is a number of elements a client intends to store.
-	n uint32
+	n uint64
+	// count is a number of insertions so far (repeated elements are counted as well).
+	// It predicts the fill cheaply without counting set bits.
+	count uint64
+	// maxElementLen is the length of the longest added element.
+	maxElementLen int
 	// bitstore is a bit array of uint64 bit buckets.
 	bitstore []uint64
+	// hasher creates a hash function to derive bit positions from, SHA-256 is used when it's nil.
+	hasher func() hash.Hash
+	// derivation is how bit positions are derived from the element's hashes.
+	derivation derivation
+	// reduceModulo is set for filters decoded from the encodings before version 3
+	// which reduced hashes to bit positions with modulo bitlen instead of Lemire's reduction.
+	reduceModulo bool
+}
+
+// derivation defines how an element's bit positions are derived from its hashes.
+type derivation byte
+
+const (
+	// derivePerIndex hashes the element followed by the hash function index for each position.
+	derivePerIndex derivation = iota
+	// deriveDouble hashes the element once and derives positions with Kirsch-Mitzenmacher double hashing.
+	deriveDouble
+	// deriveWide hashes the element followed by the digest index, and slices each digest into 64-bit lanes, one per position.
+	deriveWide
+)
+
+// Option configures a Bloom filter created by New.
+type Option func(*Filter)
+
+// WithHasher sets the hash constructor the filter derives bit positions from, e.g., a fast non-cryptographic hash.
+// SHA-256 is used by default. The hash function must produce at least 8 bytes sums
+// (16 bytes WithDoubleHashing), otherwise Add and Has return ErrHashSize.
+// Positions are derived from the high bits of the sums, so they must be well mixed (FNV, for example, is not).
+// Note, filters are only compatible (can be merged or intersected) if they use the same hash function.
+func WithHasher(h func() hash.Hash) Option {
+	return func(bf *Filter) {
+		bf.hasher = h
+	}
+}
+
+// WithDoubleHashing makes the filter hash an element once and derive all its bit positions
+// from two 64-bit halves h1 and h2 of the digest as reduce(h1 + i*h2, bitlen) (Kirsch-Mitzenmacher double hashing).
+// It's about hashqty times cheaper than computing a digest per hash function with a negligible effect
+// on the false positive rate, but the positions differ from the default ones,
+// so it must not be used to query filters populated without this option.
+// A decoded filter uses the derivation it was encoded with.
+// The hash function must produce at least 16 bytes sums, otherwise Add and Has return ErrHashSize.
+func WithDoubleHashing() Option {
+	return func(bf *Filter) {
+		bf.derivation = deriveDouble
+	}
+}
+
+// WithWideHashing makes the filter use the whole digest instead of only its first 64 bits:
+// a digest is sliced into 64-bit lanes, and each lane gives a bit position,
+// cutting the number of SHA-256 invocations by up to 4 times.
+// The first position matches the default one, but the rest differ,
+// so it must not be used to query filters populated without this option.
+// A decoded filter uses the derivation it was encoded with.
+func WithWideHashing() Option {
+	return func(bf *Filter) {
+		bf.derivation = deriveWide
+	}
 }
 
 // New creates a new Bloom filter for n elements based on
 // tolerated error rate of false positives (whether set contains an element).
-func New(n uint32, prob float64) (*Filter, error) {
+// The filter can be configured with options, e.g., WithHasher.
+// ErrTooManyElements is returned when the bit array for n elements doesn't fit into memory (see maxBuckets).
+func New(n uint64, prob float64, opts ...Option) (*Filter, error) {
 	if n == 0 {
 		return nil, ErrZeroElements
 	}
-	if prob <= 0 {
-		return nil, ErrProbability
+	if err := checkProb(prob); err != nil {
+		return nil, err
 	}
 
 	bf := Filter{
@@ -46,19 +121,106 @@ func New(n uint32, prob float64) (*Filter, error) {
 	}
 	bf.hashqty = optimalHashQty(bf.prob)
 	bf.bitlen = optimalBitLen(n, bf.prob)
-	// We use uint64 bit buckets to accommodate calculated bitlen.
-	buckets := bf.bitlen / 64
-	if bf.bitlen%64 != 0 {
-		buckets++
+	if !fits(bf.bitlen) {
+		return nil, ErrTooManyElements
+	}
+	bf.bitstore = make([]uint64, bucketqty(bf.bitlen))
+	for _, opt := range opts {
+		opt(&bf)
 	}
-	bf.bitstore = make([]uint64, buckets)
 	return &bf, nil
 }
 
+// NewFromChan creates a scalable Bloom filter for the elements received from in with the compound
+// prob probability of false positives.
+// Up to maxChanBuffer elements are buffered until in is closed, so they can be counted
+// before the filter is allocated, and its only filter is sized exactly for them.
+// That means the memory of all the buffered elements is held at once, e.g., 1 GB for 1 KB elements.
+// When more elements arrive, the stream is treated as unbounded: the buffered elements are moved
+// into a scalable filter sized for maxChanBuffer elements, and the rest of the stream is drained into it,
+// so it grows as needed at the cost of a slower Has.
+// An empty stream gives a filter sized for one element.
+// It returns the context's error if ctx is done before in is closed.
+func NewFromChan(ctx context.Context, prob float64, in <-chan []byte) (*ScalableFilter, error) {
+	return newFromChan(ctx, prob, in, maxChanBuffer)
+}
+
+// maxChanBuffer is how many elements NewFromChan buffers at most to size a filter.
+const maxChanBuffer = 1 << 20
+
+// newFromChan is NewFromChan which buffers at most maxBuffered elements.
+func newFromChan(ctx context.Context, prob float64, in <-chan []byte, maxBuffered int) (*ScalableFilter, error) {
+	if err := checkProb(prob); err != nil {
+		return nil, err
+	}
+	var elements [][]byte
+	for len(elements) <= maxBuffered {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case e, ok := <-in:
+			if ok {
+				elements = append(elements, e)
+				continue
+			}
+
+			sf, err := NewScalable(max(uint64(len(elements)), 1), prob)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range elements {
+				if err = sf.Add(e); err != nil {
+					return nil, err
+				}
+			}
+			return sf, nil
+		}
+	}
+
+	sf, err := NewScalable(uint64(maxBuffered), prob)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range elements {
+		if err = sf.Add(e); err != nil {
+			return nil, err
+		}
+	}
+	elements = nil
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case e, ok := <-in:
+			if !ok {
+				return sf, nil
+			}
+			if err = sf.Add(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// FromMap creates a Bloom filter sized for len(m) elements and adds every key of the map,
+// e.g., to replace a map[string]struct{} allowlist with a more compact filter.
+func FromMap[V any](m map[string]V, prob float64) (*Filter, error) {
+	bf, err := New(uint64(len(m)), prob)
+	if err != nil {
+		return nil, err
+	}
+	for k := range m {
+		if err = bf.Add([]byte(k)); err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
 // Add adds an element to the set. The error in unlikely to happen,
 // unless underlying hash function fails.
 func (bf *Filter) Add(element []byte) error {
-	pos, err := bitpositions(element, bf.hashqty, bf.bitlen)
+	pos, err := bf.positions(element, bf.hashqty)
 	if err != nil {
 		return err
 	}
@@ -69,6 +231,85 @@ func (bf *Filter) Add(element []byte) error {
 		mask = 1 << offset
 		bf.bitstore[index] |= mask
 	}
+	bf.count++
+	if len(element) > bf.maxElementLen {
+		bf.maxElementLen = len(element)
+	}
+	return nil
+}
+
+// AddAll adds the elements to the set.
+// It stops on the first element that fails to be hashed and returns the error,
+// the elements before it remain added.
+func (bf *Filter) AddAll(elements [][]byte) error {
+	for _, e := range elements {
+		if err := bf.Add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestAndAdd adds the element to the set and reports whether it was possibly in the set before,
+// i.e., all its bits were already set. It hashes the element once unlike Has followed by Add.
+func (bf *Filter) TestAndAdd(element []byte) (bool, error) {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return false, err
+	}
+
+	wasIn := true
+	var mask uint64
+	for _, p := range pos {
+		index, offset := bitlocation(p, 64)
+		mask = 1 << offset
+		if (bf.bitstore[index] & mask) == 0 {
+			wasIn = false
+			bf.bitstore[index] |= mask
+		}
+	}
+	bf.count++
+	if len(element) > bf.maxElementLen {
+		bf.maxElementLen = len(element)
+	}
+	return wasIn, nil
+}
+
+// AddString adds the string element to the set like Add does,
+// but it doesn't allocate to convert the string to bytes.
+func (bf *Filter) AddString(s string) error {
+	return bf.Add(stringBytes(s))
+}
+
+// HasString tests if the string element is in the set like Has does,
+// but it doesn't allocate to convert the string to bytes.
+func (bf *Filter) HasString(s string) (bool, error) {
+	return bf.Has(stringBytes(s))
+}
+
+// stringBytes returns the bytes of s without copying them.
+// The bytes must not be modified or retained, since strings are immutable.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// AddAtomic adds the element to the set like Add does, but sets the bits with atomic OR,
+// so it can be called from many goroutines without a lock.
+// AddAtomic must not be mixed with concurrent Add calls (or any other mutating method).
+// Concurrent lookups must use HasAtomic, they may observe a partially-applied insert
+// and report the element as absent until AddAtomic returns.
+// Note, the max element length is not tracked by AddAtomic.
+func (bf *Filter) AddAtomic(element []byte) error {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pos {
+		index, offset := bitlocation(p, 64)
+		atomicOr(&bf.bitstore[index], 1<<offset)
+	}
+	atomic.AddUint64(&bf.count, 1)
 	return nil
 }
 
@@ -77,7 +318,7 @@ func (bf *Filter) Add(element []byte) error {
 func (bf *Filter) Has(element []byte) (bool, error) {
 	// bitpositions is used here for simplicity, though returning earlier
 	// when a bit in question is zero will give performance increase.
-	pos, err := bitpositions(element, bf.hashqty, bf.bitlen)
+	pos, err := bf.positions(element, bf.hashqty)
 	if err != nil {
 		return false, err
 	}
@@ -93,6 +334,297 @@ func (bf *Filter) Has(element []byte) (bool, error) {
 	return true, nil
 }
 
+// HasAtomic tests if the element is in the set like Has does, but loads the bits atomically,
+// so it can be called concurrently with AddAtomic.
+func (bf *Filter) HasAtomic(element []byte) (bool, error) {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range pos {
+		index, offset := bitlocation(p, 64)
+		if atomic.LoadUint64(&bf.bitstore[index])&(1<<offset) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Cap returns the number of elements the filter was created for.
+// Note, it returns uint64 since the number of elements isn't limited to uint32.
+func (bf *Filter) Cap() uint64 {
+	return bf.n
+}
+
+// BitLen returns the length of the bit array.
+func (bf *Filter) BitLen() uint64 {
+	return bf.bitlen
+}
+
+// HashCount returns the number of hash functions.
+func (bf *Filter) HashCount() byte {
+	return bf.hashqty
+}
+
+// Probability returns the desired probability of false positives the filter was created for.
+func (bf *Filter) Probability() float64 {
+	return bf.prob
+}
+
+// String summarizes the filter, e.g., Bloom(n=1000000, p=0.010000, m=9585059 bits, k=7, fill=12.3%).
+// The fill is computed by counting set bits, so it takes a pass over the bitstore.
+func (bf *Filter) String() string {
+	var buf [96]byte
+	b := append(buf[:0], "Bloom(n="...)
+	b = strconv.AppendUint(b, bf.n, 10)
+	b = append(b, ", p="...)
+	b = strconv.AppendFloat(b, bf.prob, 'f', 6, 64)
+	b = append(b, ", m="...)
+	b = strconv.AppendUint(b, bf.bitlen, 10)
+	b = append(b, " bits, k="...)
+	b = strconv.AppendUint(b, uint64(bf.hashqty), 10)
+	b = append(b, ", fill="...)
+	var fill float64
+	if bf.bitlen > 0 {
+		fill = bf.FillRatio() * 100
+	}
+	b = strconv.AppendFloat(b, fill, 'f', 1, 64)
+	b = append(b, "%)"...)
+	return string(b)
+}
+
+// MaxElementLen returns the length of the longest element added so far.
+// Elements added with AddPositions are not accounted for since their lengths are unknown.
+func (bf *Filter) MaxElementLen() int {
+	return bf.maxElementLen
+}
+
+// AddFixedWidth reads records of width bytes from r and adds each of them until EOF,
+// e.g., to load a binary dump of fixed-size keys. It returns the number of added records.
+// A trailing partial record results in io.ErrUnexpectedEOF.
+func (bf *Filter) AddFixedWidth(r io.Reader, width int) (count uint64, err error) {
+	if width <= 0 {
+		return 0, ErrRecordWidth
+	}
+	record := make([]byte, width)
+	for {
+		if _, err = io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return count, err
+		}
+		if err = bf.Add(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// HasWithBudget tests if the element is in the set checking at most maxPositions of its bit positions,
+// e.g., to bound lookup latency under load. The ok result reports whether the answer is complete:
+// either all the positions were checked, or one of them was zero which means the element is definitely not in the set.
+// Note, true with ok=false is not a reliable membership assertion, it only means the checked bits were set.
+func (bf *Filter) HasWithBudget(element []byte, maxPositions int) (isIn, ok bool, err error) {
+	hashqty := bf.hashqty
+	if maxPositions < int(hashqty) {
+		if maxPositions < 0 {
+			maxPositions = 0
+		}
+		hashqty = byte(maxPositions)
+	}
+	pos, err := bf.positions(element, hashqty)
+	if err != nil {
+		return false, false, err
+	}
+
+	var mask uint64
+	for _, p := range pos {
+		index, offset := bitlocation(p, 64)
+		mask = 1 << offset
+		if (bf.bitstore[index] & mask) == 0 {
+			return false, true, nil
+		}
+	}
+	return true, hashqty == bf.hashqty, nil
+}
+
+// ShardOf returns a shard index in [0, shards) for the element.
+// It is derived from the element's first hash function the same way as its first bit position,
+// so sharding stays consistent with the filter's hashing (WithDoubleHashing as well).
+func (bf *Filter) ShardOf(element []byte, shards int) (int, error) {
+	if shards <= 0 {
+		return 0, ErrShards
+	}
+	b := make([]byte, len(element)+1)
+	copy(b, element)
+	if bf.derivation == deriveDouble {
+		b = b[:len(element)]
+	}
+	if bf.reduceModulo {
+		pos, err := modulopositions(element, 1, uint64(shards), bf.hasher)
+		if err != nil {
+			return 0, err
+		}
+		return int(pos[0]), nil
+	}
+	shard, err := bitposition(b, uint64(shards), bf.hasher)
+	return int(shard), err
+}
+
+// PrecomputePositions hashes all the elements into their bit positions without modifying the filter,
+// so that hashing can be separated from writing bits with AddPositions.
+// Note, it holds hashqty uint64 positions per element in memory, e.g., 56 bytes per element when hashqty is 7.
+func (bf *Filter) PrecomputePositions(elements [][]byte) ([][]uint64, error) {
+	positions := make([][]uint64, len(elements))
+	for i, e := range elements {
+		pos, err := bf.positions(e, bf.hashqty)
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = pos
+	}
+	return positions, nil
+}
+
+// AddPositions sets the bit positions returned by PrecomputePositions
+// which is equivalent to adding the corresponding elements.
+// The positions must be computed by a filter with the same bitlen and hashqty.
+func (bf *Filter) AddPositions(positions [][]uint64) {
+	for _, pos := range positions {
+		for _, p := range pos {
+			index, offset := bitlocation(p, 64)
+			bf.bitstore[index] |= 1 << offset
+		}
+		bf.count++
+	}
+}
+
+// PackPositions returns the element's bit positions encoded as unsigned varints,
+// so a node can announce an element to another one without sending the element itself.
+// The receiving filter applies them with ApplyPackedPositions.
+func (bf *Filter) PackPositions(element []byte) ([]byte, error) {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return nil, err
+	}
+	packed := make([]byte, 0, len(pos)*binary.MaxVarintLen64)
+	for _, p := range pos {
+		packed = binary.AppendUvarint(packed, p)
+	}
+	return packed, nil
+}
+
+// ApplyPackedPositions sets the bit positions encoded by PackPositions which is equivalent to adding the element.
+// The packed positions of several elements can be concatenated.
+// The positions must be packed by a filter with the same bitlen and hashqty.
+// ErrPackedPositions is returned if the data is malformed, a position is out of the bit array range,
+// or the number of positions is not a multiple of hashqty, e.g., the data was truncated;
+// the filter is left unmodified then.
+func (bf *Filter) ApplyPackedPositions(packed []byte) error {
+	pos := make([]uint64, 0, bf.hashqty)
+	for len(packed) > 0 {
+		p, n := binary.Uvarint(packed)
+		if n <= 0 || p >= bf.bitlen {
+			return ErrPackedPositions
+		}
+		pos = append(pos, p)
+		packed = packed[n:]
+	}
+	k := int(bf.hashqty)
+	if k == 0 || len(pos)%k != 0 {
+		return ErrPackedPositions
+	}
+
+	positions := make([][]uint64, 0, len(pos)/k)
+	for i := 0; i < len(pos); i += k {
+		positions = append(positions, pos[i:i+k])
+	}
+	bf.AddPositions(positions)
+	return nil
+}
+
+// TryAdd adds an element only if the false positive rate predicted from the number of insertions
+// stays within the filter's probability after that, otherwise it returns added=false.
+// It is an opt-in strict admission which enforces the probability contract
+// by rejecting elements once the filter reaches its capacity.
+// Note, repeated elements are counted every time they are added.
+func (bf *Filter) TryAdd(element []byte) (added bool, err error) {
+	if theoreticalFPR(float64(bf.count+1), bf.hashqty, bf.bitlen) > bf.prob {
+		return false, nil
+	}
+	if err = bf.Add(element); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Digest returns the sum the filter computes for the element's first hash function,
+// i.e., the hash (SHA-256 by default) of the element followed by the hash function index 0.
+// The first 8 bytes of the digest reduced to bitlen range (see reduce) give the element's first bit position
+// (modulo bitlen for a filter decoded from the encodings before version 3).
+// WithDoubleHashing the digest is the hash of the element itself which all the positions are derived from.
+func (bf *Filter) Digest(element []byte) []byte {
+	b := make([]byte, len(element)+1)
+	copy(b, element)
+	if bf.derivation == deriveDouble {
+		b = b[:len(element)]
+	}
+	d := getHash(bf.hasher)
+	defer putHash(bf.hasher, d)
+	d.Write(b)
+	return d.Sum(nil)
+}
+
+// Clone returns an independent copy of the filter, e.g., to snapshot its state before speculative inserts.
+// The bitstore is copied, so adding elements to the clone doesn't affect the source filter and vice versa.
+func (bf *Filter) Clone() *Filter {
+	clone := *bf
+	clone.bitstore = make([]uint64, len(bf.bitstore))
+	copy(clone.bitstore, bf.bitstore)
+	return &clone
+}
+
+// Bits returns a copy of the bitstore, e.g., to measure later how many bits were set since then with NewBitsSince.
+func (bf *Filter) Bits() []uint64 {
+	b := make([]uint64, len(bf.bitstore))
+	copy(b, bf.bitstore)
+	return b
+}
+
+// NewBitsSince returns how many bits are set now that weren't set in the snapshot taken with Bits,
+// i.e., the information added by the latest elements: popcount(now & ^snapshot).
+// ErrSnapshotLength is returned if the snapshot length doesn't match the bitstore.
+func (bf *Filter) NewBitsSince(snapshot []uint64) (uint64, error) {
+	if len(snapshot) != len(bf.bitstore) {
+		return 0, ErrSnapshotLength
+	}
+	var c uint64
+	for i, b := range bf.bitstore {
+		c += uint64(bits.OnesCount64(b &^ snapshot[i]))
+	}
+	return c, nil
+}
+
+// Reset removes all the elements from the set, so the filter can be reused without allocating a new one.
+// The bitstore is zeroed in place, i.e., its memory is retained,
+// and the filter parameters (prob, bitlen, hashqty, n) stay intact.
+func (bf *Filter) Reset() {
+	clear(bf.bitstore)
+	bf.count = 0
+	bf.maxElementLen = 0
+}
+
+// Swap returns a snapshot of the filter and clears the filter in place reusing its bitstore,
+// e.g., in a double-buffered pipeline where one stage reads the old state while a producer starts fresh.
+// Note, it's not concurrency safe.
+func (bf *Filter) Swap() *Filter {
+	snapshot := bf.Clone()
+	bf.Reset()
+	return snapshot
+}
+
 // MustAdd is similar to Add, but it panics if the error is not nil.
 // Underlying hash function is cause of an error.
 func (bf *Filter) MustAdd(element []byte) {
@@ -111,32 +643,391 @@ func (bf *Filter) MustHave(element []byte) bool {
 	return isIn
 }
 
+// BitsForAdditional returns how many bits a filter with the same probability of false positives
+// would need to hold m more elements than this one, e.g., to size a successor filter during rotation.
+// The number of elements is capped at 18,446,744,073,709,551,615 which is the most a filter supports.
+func (bf *Filter) BitsForAdditional(m uint64) uint64 {
+	n := bf.n + m
+	if n < bf.n {
+		n = math.MaxUint64
+	}
+	return optimalBitLen(n, bf.prob)
+}
+
+// KComparison returns the number of hash functions the filter uses (derived from the probability)
+// and the number that is optimal for its actual size round(bitlen/n * ln2).
+// They can differ due to rounding of bitlen and hashqty.
+func (bf *Filter) KComparison() (used byte, sizeOptimal byte) {
+	return bf.hashqty, optimalHashQtyForSize(bf.n, bf.bitlen)
+}
+
+// SelfCheck adds the elements and verifies every one of them is reported as present.
+// A Bloom filter never has false negatives, so an error naming the first missing element
+// indicates a bug in hashing or bit addressing.
+func (bf *Filter) SelfCheck(elements [][]byte) error {
+	for _, e := range elements {
+		if err := bf.Add(e); err != nil {
+			return err
+		}
+	}
+	for _, e := range elements {
+		isIn, err := bf.Has(e)
+		if err != nil {
+			return err
+		}
+		if !isIn {
+			return fmt.Errorf("element %q is not found after it was added", e)
+		}
+	}
+	return nil
+}
+
+// Intersect ANDs the other filter into bf, so bf approximates the intersection of the sets.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+// Note, the intersection of Bloom filters is approximate: elements of both sets are still reported,
+// but so are the elements whose bits happened to be set by different elements in each filter,
+// so the result may have more false positives than either input.
+func (bf *Filter) Intersect(other *Filter) error {
+	if !bf.compatible(other) {
+		return ErrIncompatible
+	}
+	for i, b := range other.bitstore {
+		bf.bitstore[i] &= b
+	}
+	return nil
+}
+
+// Intersection returns a new filter whose bitstore is a bitwise AND of a and b bitstores, the operands aren't modified.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+// Note, the result over-approximates the true intersection of the sets:
+// it reports elements of both sets, but also those whose bits happened to be set by different elements in a and b.
+func Intersection(a, b *Filter) (*Filter, error) {
+	bf := a.Clone()
+	if err := bf.Intersect(b); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// UnionContributions estimates the number of elements in each filter and in their union
+// in one pass over the bitstores, e.g., to understand the overlap across partitions.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+func UnionContributions(filters ...*Filter) ([]uint64, uint64, error) {
+	if len(filters) == 0 {
+		return nil, 0, nil
+	}
+	first := filters[0]
+	for _, bf := range filters[1:] {
+		if !first.compatible(bf) {
+			return nil, 0, ErrIncompatible
+		}
+	}
+
+	setbits := make([]uint64, len(filters))
+	var unionbits uint64
+	for i := range first.bitstore {
+		// Bits beyond bitlen are not counted like in SetBits.
+		mask := first.bucketMask(i)
+		var union uint64
+		for j, bf := range filters {
+			setbits[j] += uint64(bits.OnesCount64(bf.bitstore[i] & mask))
+			union |= bf.bitstore[i]
+		}
+		unionbits += uint64(bits.OnesCount64(union & mask))
+	}
+
+	counts := make([]uint64, len(filters))
+	for i := range setbits {
+		counts[i] = approxCount(setbits[i], first.hashqty, first.bitlen)
+	}
+	return counts, approxCount(unionbits, first.hashqty, first.bitlen), nil
+}
+
+// Fold returns a new filter that is factor times smaller than bf, the source filter isn't modified.
+// Position p of the bit array becomes p / factor, i.e., each run of factor adjacent bits is ORed into one bit.
+// Since the hash is reduced to a position as the high bits of hash*bitlen, the folded filter addresses elements
+// exactly like a filter created with bitlen/factor bits, so it keeps the no-false-negatives guarantee
+// while its false positive rate grows. bitlen must be divisible by factor, otherwise ErrFoldFactor is returned.
+// A filter decoded from the encodings before version 3 reduced hashes with modulo,
+// so its position p becomes p % (bitlen/factor) instead.
+func (bf *Filter) Fold(factor int) (*Filter, error) {
+	if factor <= 0 || bf.bitlen%uint64(factor) != 0 {
+		return nil, ErrFoldFactor
+	}
+	folded := *bf
+	folded.bitlen = bf.bitlen / uint64(factor)
+	folded.bitstore = make([]uint64, bucketqty(folded.bitlen))
+	bf.eachSetBit(func(p uint64) {
+		index, offset := bitlocation(bf.rescale(p, folded.bitlen), 64)
+		folded.bitstore[index] |= 1 << offset
+	})
+	return &folded, nil
+}
+
+// rescale maps position p of the bit array to the position in a bit array of bitlen bits, bitlen must divide bf.bitlen.
+func (bf *Filter) rescale(p, bitlen uint64) uint64 {
+	if bf.reduceModulo {
+		return p % bitlen
+	}
+	return p / (bf.bitlen / bitlen)
+}
+
+// RepairBitstore makes the bitstore length match bitlen, e.g., after a buggy deserialization.
+// A short bitstore is zero-extended, and a long one is truncated unless the excess buckets have set bits,
+// in which case ErrBitstoreExcess is returned and the bitstore is left unmodified.
+func (bf *Filter) RepairBitstore() error {
+	want := int(bucketqty(bf.bitlen))
+	if len(bf.bitstore) < want {
+		bf.bitstore = append(bf.bitstore, make([]uint64, want-len(bf.bitstore))...)
+		return nil
+	}
+	for _, b := range bf.bitstore[want:] {
+		if b != 0 {
+			return ErrBitstoreExcess
+		}
+	}
+	bf.bitstore = bf.bitstore[:want]
+	return nil
+}
+
+// compatible reports whether the filters have the same parameters,
+// so their bitstores address elements identically.
+func (bf *Filter) compatible(other *Filter) bool {
+	return bf.bitlen == other.bitlen && bf.hashqty == other.hashqty && bf.n == other.n &&
+		bf.derivation == other.derivation && bf.reduceModulo == other.reduceModulo
+}
+
+// SampleFalsePositives generates n candidates with gen and returns those the filter falsely reports as present.
+// The generator must produce elements that were never added, otherwise true positives end up in the sample.
+// The number of returned elements depends on the filter's false positive rate,
+// e.g., roughly n*prob for a filter filled up to its capacity.
+func (bf *Filter) SampleFalsePositives(n int, gen func(i int) []byte) [][]byte {
+	var fp [][]byte
+	for i := 0; i < n; i++ {
+		element := gen(i)
+		if isIn, err := bf.Has(element); err == nil && isIn {
+			fp = append(fp, element)
+		}
+	}
+	return fp
+}
+
+// AddsUntilFPR estimates how many more elements can be added before
+// the false positive rate reaches target. The current number of elements is
+// estimated from the filter's fill, so the result is approximate.
+// Zero or a negative number means the filter is already past the target.
+func (bf *Filter) AddsUntilFPR(target float64) int64 {
+	limit := elementsAtFPR(target, bf.hashqty, bf.bitlen)
+	if math.IsInf(limit, 1) {
+		return math.MaxInt64
+	}
+	count := estimateCount(bf.SetBits(), bf.hashqty, bf.bitlen)
+	if math.IsInf(count, 1) {
+		return 0
+	}
+	return int64(math.Floor(limit - count))
+}
+
+// HalfLife estimates how long it takes, at steady insertsPerSecond rate, until the filter's false positive rate
+// reaches twice the desired probability, i.e., when the filter should be rotated.
+// Zero is returned if the filter is already past that point.
+// The maximum duration is returned when the rate is not positive or the point is never reached.
+func (bf *Filter) HalfLife(insertsPerSecond float64) time.Duration {
+	adds := bf.AddsUntilFPR(2 * bf.prob)
+	if adds <= 0 {
+		return 0
+	}
+	if insertsPerSecond <= 0 || adds == math.MaxInt64 {
+		return math.MaxInt64
+	}
+	d := float64(adds) / insertsPerSecond * float64(time.Second)
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// ExpectedFalsePositivesPerSec translates the current false positive rate into a downstream load:
+// how many queries per second are expected to be false positives given qps queries per second
+// of which absentFraction are for elements not in the set, e.g., wasted database lookups.
+func (bf *Filter) ExpectedFalsePositivesPerSec(qps float64, absentFraction float64) float64 {
+	return qps * absentFraction * bf.CurrentFalsePositiveRate()
+}
+
+// EfficiencyReport summarizes how close the filter's storage is to the information-theoretic optimum:
+// bitlen, allocated bits (bitstore rounds bitlen up to 64 bits buckets), wasted bits,
+// bits per element, and theoretical minimum bits -n*ln(prob)/ln(2)^2 for the desired probability.
+func (bf *Filter) EfficiencyReport() string {
+	allocated := uint64(len(bf.bitstore)) * 64
+	ln2 := math.Log(2)
+	minimum := -float64(bf.n) * math.Log(bf.prob) / (ln2 * ln2)
+	return fmt.Sprintf(
+		"bitlen=%d allocated=%d wasted=%d bits/element=%.6f theoretical=%.2f",
+		bf.bitlen, allocated, allocated-bf.bitlen, float64(bf.bitlen)/float64(bf.n), minimum,
+	)
+}
+
+// eachSetBit calls fn with a position of every set bit in the bitstore in ascending order.
+// Bits of the last bucket beyond bitlen are skipped.
+func (bf *Filter) eachSetBit(fn func(p uint64)) {
+	for i, b := range bf.bitstore {
+		b &= bf.bucketMask(i)
+		for b != 0 {
+			offset := bits.TrailingZeros64(b)
+			fn(uint64(i)*64 + uint64(offset))
+			b &= b - 1
+		}
+	}
+}
+
+// bucketqty returns how many uint64 bit buckets are needed to accommodate bitlen bits.
+func bucketqty(bitlen uint64) uint64 {
+	buckets := bitlen / 64
+	if bitlen%64 != 0 {
+		buckets++
+	}
+	return buckets
+}
+
+// maxBuckets is the largest bitstore a filter can have.
+// The Go runtime refuses to allocate more than 2^48 bytes on 64-bit platforms,
+// and a slice can't be longer than math.MaxInt bytes on 32-bit ones.
+const maxBuckets = min(1<<48, math.MaxInt) / 8
+
+// fits reports whether a bitstore for bitlen bits can be allocated.
+func fits(bitlen uint64) bool {
+	return bitlen != math.MaxUint64 && bucketqty(bitlen) <= maxBuckets
+}
+
+// checkProb returns an error if prob is not a valid probability of false positives.
+func checkProb(prob float64) error {
+	if prob <= 0 {
+		return ErrProbability
+	}
+	if prob >= 1 {
+		return ErrProbabilityRange
+	}
+	return nil
+}
+
+// theoreticalFPR returns the expected probability of false positives
+// after n elements were added to a filter of bitlen bits with hashqty hash functions: (1 - e^(-kn/m))^k.
+func theoreticalFPR(n float64, hashqty byte, bitlen uint64) float64 {
+	k := float64(hashqty)
+	return math.Pow(1-math.Exp(-k*n/float64(bitlen)), k)
+}
+
+// elementsAtFPR solves theoreticalFPR for n, i.e., it finds how many elements
+// a filter can hold until the false positive rate reaches prob: -m/k * ln(1 - prob^(1/k)).
+func elementsAtFPR(prob float64, hashqty byte, bitlen uint64) float64 {
+	if prob <= 0 {
+		return 0
+	}
+	if prob >= 1 {
+		return math.Inf(1)
+	}
+	k := float64(hashqty)
+	return -float64(bitlen) / k * math.Log(1-math.Pow(prob, 1/k))
+}
+
+// estimateCount approximates the number of elements in a filter
+// based on setbits number of set bits: -m/k * ln(1 - X/m).
+// It returns +Inf when all the bits are set.
+func estimateCount(setbits uint64, hashqty byte, bitlen uint64) float64 {
+	m := float64(bitlen)
+	return -m / float64(hashqty) * math.Log(1-float64(setbits)/m)
+}
+
+// approxCount is similar to estimateCount, but it rounds the estimate.
+// When all the bits are set, the estimate is capped as if a single bit was still zero.
+func approxCount(setbits uint64, hashqty byte, bitlen uint64) uint64 {
+	if setbits >= bitlen {
+		return uint64(math.Round(-float64(bitlen) / float64(hashqty) * math.Log(1/float64(bitlen))))
+	}
+	return uint64(math.Round(estimateCount(setbits, hashqty, bitlen)))
+}
+
 // optimalBitLen finds the optimal length of a bit array
 // based on n number of elements in a set and prob error rate (probability of false positives).
-func optimalBitLen(n uint32, prob float64) uint64 {
+// float64 represents n exactly up to 2^53, and the relative error of the product is about 1e-16,
+// so the length is off by a fraction of a bit even for tens of billions of elements.
+// The length saturates at math.MaxUint64 if it doesn't fit into uint64.
+func optimalBitLen(n uint64, prob float64) uint64 {
 	ln2 := math.Log(2)
-	optLen := -float64(n) * math.Log(prob) / (ln2 * ln2)
-	return uint64(math.Ceil(optLen))
+	optLen := math.Ceil(-float64(n) * math.Log(prob) / (ln2 * ln2))
+	if optLen >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(optLen)
 }
 
 // optimalHashQty finds the optimal count of hash functions based on desired probability of an error.
+// There is at least one hash function, otherwise a filter couldn't store anything.
 func optimalHashQty(prob float64) byte {
 	optQty := -math.Log(prob) / math.Log(2)
-	return byte(math.Ceil(optQty))
+	return byte(max(math.Ceil(optQty), 1))
+}
+
+// optimalHashQtyForSize finds the optimal count of hash functions
+// for a bit array of bitlen length that stores n elements.
+func optimalHashQtyForSize(n uint64, bitlen uint64) byte {
+	optQty := float64(bitlen) / float64(n) * math.Log(2)
+	return byte(math.Round(optQty))
+}
+
+// positions returns hashqty bit positions of the element according to the filter's derivation.
+func (bf *Filter) positions(element []byte, hashqty byte) ([]uint64, error) {
+	if bf.reduceModulo {
+		return modulopositions(element, hashqty, bf.bitlen, bf.hasher)
+	}
+	switch bf.derivation {
+	case deriveDouble:
+		return doublepositions(element, hashqty, bf.bitlen, bf.hasher)
+	case deriveWide:
+		return bitpositionsWide(element, hashqty, bf.bitlen, bf.hasher)
+	}
+	return bitpositions(element, hashqty, bf.bitlen, bf.hasher)
+}
+
+// bitpositions applies hashQty hash functions to an element to calculate its bit positions, see Positions.
+func bitpositions(element []byte, hashqty byte, bitlen uint64, h func() hash.Hash) ([]uint64, error) {
+	return Positions(element, hashqty, bitlen, h)
 }
 
-// bitpositions applies hashQty hash functions to an element to calculate its bit positions.
-// They are used to add an element or test whether it is in the set.
-func bitpositions(element []byte, hashqty byte, bitlen uint64) ([]uint64, error) {
+// shortElementLen is the max length of an element that Positions concatenates with a hash index on the stack.
+const shortElementLen = 63
+
+// Positions returns hashqty bit positions of the element in a bit array of bitlen bits, the same ones a filter uses
+// to add the element or test whether it is in the set (unless it was created WithDoubleHashing or WithWideHashing,
+// or decoded from the encodings before version 3),
+// e.g., to shard external storage consistently.
+// The element followed by a hash function index is hashed with h, or SHA-256 if h is nil,
+// and the first 8 bytes of the digest are reduced to [0, bitlen) range.
+func Positions(element []byte, hashqty byte, bitlen uint64, h func() hash.Hash) ([]uint64, error) {
+	pos := make([]uint64, hashqty)
+	// Short elements hashed with SHA-256 are concatenated with a hash index in a buffer on the stack.
+	// It must not be passed to hash.Hash, otherwise the buffer escapes to the heap.
+	if h == nil && len(element) <= shortElementLen {
+		var buf [shortElementLen + 1]byte
+		n := copy(buf[:], element)
+		for i := range pos {
+			buf[n] = byte(i)
+			sum := sha256.Sum256(buf[:n+1])
+			pos[i] = reduce(binary.BigEndian.Uint64(sum[:]), bitlen)
+		}
+		return pos, nil
+	}
+
 	var err error
 	// We'll concat element and hash index to obtain hashQty bit positions.
 	b := make([]byte, len(element)+1)
 	copy(b, element)
 
-	pos := make([]uint64, hashqty)
+	d := getHash(h)
+	defer putHash(h, d)
 	for i := byte(0); i < hashqty; i++ {
 		b[len(element)] = i
-		pos[i], err = hash(b, bitlen)
+		pos[i], err = sumposition(d, b, bitlen)
 		if err != nil {
 			break
 		}
@@ -144,23 +1035,143 @@ func bitpositions(element []byte, hashqty byte, bitlen uint64) ([]uint64, error)
 	return pos, err
 }
 
-// hash returns a position in the bit array by hashing b.
-// sha256(b) hexdigest is converted to a number which is "truncated" to fit into bitlen range.
-func hash(b []byte, bitlen uint64) (uint64, error) {
-	h := sha256.New()
-	if _, err := h.Write(b); err != nil {
-		return 0, err
+// bitpositionsWide calculates hashqty bit positions of an element using all the bits of its digests.
+// The element followed by a digest index is hashed with h (SHA-256 if h is nil),
+// and every 8 bytes of the digest are read as a big-endian number reduced to bitlen range,
+// e.g., a SHA-256 digest gives 4 positions.
+func bitpositionsWide(element []byte, hashqty byte, bitlen uint64, h func() hash.Hash) ([]uint64, error) {
+	b := make([]byte, len(element)+1)
+	copy(b, element)
+
+	d := getHash(h)
+	defer putHash(h, d)
+	pos := make([]uint64, 0, hashqty)
+	for i := byte(0); len(pos) < int(hashqty); i++ {
+		b[len(element)] = i
+		d.Reset()
+		if _, err := d.Write(b); err != nil {
+			return nil, err
+		}
+		sum := d.Sum(nil)
+		if len(sum) < 8 {
+			return nil, ErrHashSize
+		}
+		for lane := 0; lane+8 <= len(sum) && len(pos) < int(hashqty); lane += 8 {
+			pos = append(pos, reduce(binary.BigEndian.Uint64(sum[lane:]), bitlen))
+		}
+	}
+	return pos, nil
+}
+
+// doublepositions calculates hashqty bit positions of an element by hashing it once with h (SHA-256 if h is nil).
+// The first two 8 bytes of the digest are read as big-endian numbers h1 and h2,
+// and the i-th position is h1 + i*h2 reduced to bitlen range.
+func doublepositions(element []byte, hashqty byte, bitlen uint64, h func() hash.Hash) ([]uint64, error) {
+	d := getHash(h)
+	defer putHash(h, d)
+	if _, err := d.Write(element); err != nil {
+		return nil, err
+	}
+	var buf [sha256.Size]byte
+	sum := d.Sum(buf[:0])
+	if len(sum) < 16 {
+		return nil, ErrHashSize
+	}
+
+	h1 := binary.BigEndian.Uint64(sum)
+	h2 := binary.BigEndian.Uint64(sum[8:])
+	pos := make([]uint64, hashqty)
+	for i := range pos {
+		pos[i] = reduce(h1+uint64(i)*h2, bitlen)
+	}
+	return pos, nil
+}
+
+// modulopositions is similar to bitpositions, but it reduces the hashes to bit positions with modulo bitlen
+// like the package did before Lemire's reduction, so filters decoded from the older encodings are queried correctly.
+func modulopositions(element []byte, hashqty byte, bitlen uint64, h func() hash.Hash) ([]uint64, error) {
+	b := make([]byte, len(element)+1)
+	copy(b, element)
+
+	d := getHash(h)
+	defer putHash(h, d)
+	pos := make([]uint64, hashqty)
+	for i := range pos {
+		b[len(element)] = byte(i)
+		x, err := sumhash(d, b)
+		if err != nil {
+			return nil, err
+		}
+		pos[i] = x % bitlen
 	}
+	return pos, nil
+}
 
-	hexdigest := fmt.Sprintf("%x", h.Sum(nil))
-	// We use first 16 chars of the hex digest to create a number.
-	// If we use more chars, then it overflows.
-	i, err := strconv.ParseUint(hexdigest[:16], 16, 64)
+// bitposition returns a position in the bit array by hashing b with the hash function created by h.
+// The first 8 bytes of the digest are read as a big-endian number which is reduced to fit into bitlen range.
+func bitposition(b []byte, bitlen uint64, h func() hash.Hash) (uint64, error) {
+	d := getHash(h)
+	defer putHash(h, d)
+	return sumposition(d, b, bitlen)
+}
+
+// sumposition is similar to bitposition, but it hashes b with d after resetting it.
+func sumposition(d hash.Hash, b []byte, bitlen uint64) (uint64, error) {
+	x, err := sumhash(d, b)
 	if err != nil {
 		return 0, err
 	}
-	// Fit i into the range of the bit array.
-	return i % bitlen, nil
+	return reduce(x, bitlen), nil
+}
+
+// sumhash hashes b with d after resetting it and returns the first 8 bytes of the digest as a big-endian number.
+func sumhash(d hash.Hash, b []byte) (uint64, error) {
+	d.Reset()
+	if _, err := d.Write(b); err != nil {
+		return 0, err
+	}
+
+	var buf [sha256.Size]byte
+	sum := d.Sum(buf[:0])
+	if len(sum) < 8 {
+		return 0, ErrHashSize
+	}
+	return binary.BigEndian.Uint64(sum), nil
+}
+
+// reduce maps a uniformly distributed x into [0, bitlen) range without bias using Lemire's multiply-shift reduction,
+// i.e., it returns the high 64 bits of the 128-bit product x*bitlen.
+// Unlike x % bitlen, it doesn't favor lower positions when bitlen doesn't divide 2^64.
+// Note, it changed the positions compared to the modulo reduction used before,
+// so filters decoded from the older encodings keep using modulo (see encodingVersion).
+func reduce(x, bitlen uint64) uint64 {
+	hi, _ := bits.Mul64(x, bitlen)
+	return hi
+}
+
+// sha256Pool reuses SHA-256 hash states to avoid allocating one per Add or Has call.
+var sha256Pool = sync.Pool{
+	New: func() any {
+		return sha256.New()
+	},
+}
+
+// getHash returns a hash function created with h, or a SHA-256 one from the pool if h is nil.
+// It should be returned with putHash when it's no longer needed.
+func getHash(h func() hash.Hash) hash.Hash {
+	if h == nil {
+		d := sha256Pool.Get().(hash.Hash)
+		d.Reset()
+		return d
+	}
+	return h()
+}
+
+// putHash returns the SHA-256 hash function d to the pool if h is nil.
+func putHash(h func() hash.Hash, d hash.Hash) {
+	if h == nil {
+		sha256Pool.Put(d)
+	}
 }
 
 // bitlocation returns index in a bitstore and bit offset in bit bucket.
@@ -1,20 +1,36 @@
 package bloom
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestOptimalBitLen(t *testing.T) {
 	tt := []struct {
-		n    uint32
+		n    uint64
 		prob float64
 		want uint64
 	}{
 		{0, 0.01, 0},
-		{1000000, 0.01, 9585059},        // 1.198 MB
-		{2147483647, 0.01, 20583756121}, // 2.573 GB
-		{4294967295, 0.01, 41167512252}, // 5.146 GB
+		{1000000, 0.01, 9585059},         // 1.198 MB
+		{2147483647, 0.01, 20583756121},  // 2.573 GB
+		{4294967295, 0.01, 41167512252},  // 5.146 GB
+		{10000000000, 0.01, 95850583774}, // 11.98 GB
+		{math.MaxUint64, 0.01, math.MaxUint64},
 	}
 
 	for _, tc := range tt {
@@ -35,6 +51,9 @@ func TestOptimalHashQty(t *testing.T) {
 		{0.0123, 7},
 		{0.001, 10},
 		{0.0001001231231, 14},
+		{0.99999, 1},
+		{1, 1},
+		{1.5, 1},
 	}
 
 	for _, tc := range tt {
@@ -51,25 +70,65 @@ func TestHash(t *testing.T) {
 		bitlen uint64
 		want   uint64
 	}{
-		{"test", 1000000, 842533},
-		{"test", 18446744073709551615, 11495104353665842533},
-		{"test0", 48, 8},
-		{"test1", 48, 24},
-		{"test2", 48, 17},
-		{"test3", 48, 23},
+		{"test", 1000000, 623150},
+		{"test", 18446744073709551615, 11495104353665842532},
+		{"test0", 48, 16},
+		{"test1", 48, 5},
+		{"test2", 48, 18},
+		{"test3", 48, 47},
 	}
 
 	for _, tc := range tt {
-		got, err := hash([]byte(tc.b), tc.bitlen)
+		got, err := bitposition([]byte(tc.b), tc.bitlen, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 		if got != tc.want {
-			t.Errorf("hash(%q, %d) = %d, want %d", tc.b, tc.bitlen, got, tc.want)
+			t.Errorf("bitposition(%q, %d) = %d, want %d", tc.b, tc.bitlen, got, tc.want)
 		}
 	}
 }
 
+func TestReduce(t *testing.T) {
+	// Modulo favors the lower positions when bitlen doesn't divide 2^64:
+	// values below 2^64 - bitlen = 2^62 are hit twice as often as the rest of the range.
+	const (
+		bitlen  = 3 << 62
+		samples = 30000
+	)
+	var lemire, modulo [3]float64
+	for i := 0; i < samples; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("element%d", i)))
+		x := binary.BigEndian.Uint64(sum[:])
+		lemire[reduce(x, bitlen)/(bitlen/3)]++
+		modulo[(x%bitlen)/(bitlen/3)]++
+	}
+
+	chiSquare := func(observed [3]float64) float64 {
+		var chi float64
+		for _, o := range observed {
+			d := o - samples/3
+			chi += d * d / (samples / 3)
+		}
+		return chi
+	}
+	// The critical value of chi-square distribution with 2 degrees of freedom at 0.001 significance.
+	const critical = 13.816
+	if got := chiSquare(lemire); got > critical {
+		t.Errorf("reduce() chi-square = %f, want under %f", got, critical)
+	}
+	if l, m := chiSquare(lemire), chiSquare(modulo); l >= m {
+		t.Errorf("reduce() chi-square = %f, want less than modulo's %f", l, m)
+	}
+
+	if got := reduce(math.MaxUint64, 48); got != 47 {
+		t.Errorf("reduce(MaxUint64, 48) = %d, want 47", got)
+	}
+	if got := reduce(0, 48); got != 0 {
+		t.Errorf("reduce(0, 48) = %d, want 0", got)
+	}
+}
+
 func equal(s1, s2 []uint64) bool {
 	if len(s1) != len(s2) {
 		return false
@@ -89,11 +148,11 @@ func TestBitpositions(t *testing.T) {
 		bitlen  uint64
 		want    []uint64
 	}{
-		{"test", 4, 48, []uint64{7, 36, 32, 37}},
+		{"test", 4, 48, []uint64{38, 47, 35, 34}},
 	}
 
 	for _, tc := range tt {
-		got, err := bitpositions([]byte(tc.element), tc.hashqty, tc.bitlen)
+		got, err := bitpositions([]byte(tc.element), tc.hashqty, tc.bitlen, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -101,6 +160,50 @@ func TestBitpositions(t *testing.T) {
 			t.Errorf("bitpositions(%q, %d, %d) = %v, want %v", tc.element, tc.hashqty, tc.bitlen, got, tc.want)
 		}
 	}
+	// Short elements are hashed on the stack, and they must get the same positions as long ones.
+	for size := 0; size <= 2*shortElementLen; size++ {
+		element := []byte(strings.Repeat("a", size))
+		got, err := bitpositions(element, 7, 1000, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := bitpositions(element, 7, 1000, sha256.New)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(got, want) {
+			t.Errorf("bitpositions(%d bytes) = %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	got, err := Positions([]byte("test"), 4, 48, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{38, 47, 35, 34}; !equal(got, want) {
+		t.Errorf("Positions(%q, 4, 48) = %v, want %v", "test", got, want)
+	}
+
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		got, err := Positions(element, bf.hashqty, bf.bitlen, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := bf.PrecomputePositions([][]byte{element})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(got, want[0]) {
+			t.Errorf("Positions(%q) = %v, want %v", element, got, want[0])
+		}
+	}
 }
 
 func TestBitlocation(t *testing.T) {
@@ -194,8 +297,8 @@ func TestFilter_Add(t *testing.T) {
 	}
 
 	got := fmt.Sprintf("%064b", bf.bitstore[0])
-	// bit positions: 7, 36, 32, 37
-	want := "0000000000000000000000000011000100000000000000000000000010000000"
+	// bit positions: 38, 47, 35, 34
+	want := "0000000000000000100000000100110000000000000000000000000000000000"
 	if got != want {
 		t.Errorf("Add(%q) %s, want %s", element, got, want)
 	}
@@ -205,7 +308,7 @@ func TestFilter_Has(t *testing.T) {
 	bf := &Filter{
 		hashqty:  4,
 		bitlen:   48,
-		bitstore: []uint64{210453397632}, // "test" int representation of bit positions.
+		bitstore: []uint64{141063905869824}, // "test" int representation of bit positions.
 	}
 
 	tt := []struct {
@@ -228,15 +331,202 @@ func TestFilter_Has(t *testing.T) {
 	}
 }
 
+func TestWithHasher(t *testing.T) {
+	def, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err := New(1000, 0.01, WithHasher(md5.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	element := []byte("test")
+	got, err := bf.PrecomputePositions([][]byte{element})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]uint64, bf.hashqty)
+	for i := range want {
+		h := md5.New()
+		h.Write(append(element, byte(i)))
+		want[i] = reduce(binary.BigEndian.Uint64(h.Sum(nil)), bf.bitlen)
+	}
+	if !equal(got[0], want) {
+		t.Errorf("positions with md5 = %v, want %v", got[0], want)
+	}
+
+	defPos, err := def.PrecomputePositions([][]byte{element})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal(got[0], defPos[0]) {
+		t.Errorf("positions with md5 = %v, want them to differ from sha256", got[0])
+	}
+
+	bf.MustAdd(element)
+	if !bf.MustHave(element) {
+		t.Errorf("Has(%q) is false, want true", element)
+	}
+}
+
+func TestWithHasher_error(t *testing.T) {
+	bf, err := New(1000, 0.01, WithHasher(func() hash.Hash { return fnv.New32a() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bf.Add([]byte("test")); err != ErrHashSize {
+		t.Errorf("Add() error: %q, want %q", err, ErrHashSize)
+	}
+}
+
+func TestWithDoubleHashing(t *testing.T) {
+	bf, err := New(1000, 0.01, WithDoubleHashing())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	element := []byte("test")
+	got, err := bf.PrecomputePositions([][]byte{element})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(element)
+	h1 := binary.BigEndian.Uint64(sum[:])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+	want := make([]uint64, bf.hashqty)
+	for i := range want {
+		want[i] = reduce(h1+uint64(i)*h2, bf.bitlen)
+	}
+	if !equal(got[0], want) {
+		t.Errorf("positions with double hashing = %v, want %v", got[0], want)
+	}
+
+	for i := 0; i < 1000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	var fp int
+	const queries = 10000
+	for i := 0; i < 1000; i++ {
+		if e := []byte(fmt.Sprintf("element%d", i)); !bf.MustHave(e) {
+			t.Errorf("Has(%q) is false, want true", e)
+		}
+	}
+	for i := 0; i < queries; i++ {
+		if bf.MustHave([]byte(fmt.Sprintf("absent%d", i))) {
+			fp++
+		}
+	}
+	if got := float64(fp) / queries; got > 0.02 {
+		t.Errorf("false positive rate = %f, want about 0.01", got)
+	}
+
+	def, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = def.Merge(bf); err != ErrIncompatible {
+		t.Errorf("Merge() error: %v, want %q", err, ErrIncompatible)
+	}
+
+	bf, err = New(1000, 0.01, WithDoubleHashing(), WithHasher(func() hash.Hash { return fnv.New64a() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bf.Add(element); err != ErrHashSize {
+		t.Errorf("Add() error: %q, want %q", err, ErrHashSize)
+	}
+}
+
+func TestBitpositionsWide(t *testing.T) {
+	element := []byte("test")
+	for hashqty := byte(1); hashqty <= 14; hashqty++ {
+		got, err := bitpositionsWide(element, hashqty, 1000000, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != int(hashqty) {
+			t.Fatalf("bitpositionsWide(%q, %d) = %v, want %d positions", element, hashqty, got, hashqty)
+		}
+
+		for i, p := range got {
+			sum := sha256.Sum256(append(element, byte(i/4)))
+			lane := binary.BigEndian.Uint64(sum[i%4*8:])
+			if want := reduce(lane, 1000000); p != want {
+				t.Errorf("bitpositionsWide(%q, %d)[%d] = %d, want %d", element, hashqty, i, p, want)
+			}
+		}
+	}
+
+	// The first position matches the default derivation.
+	def, err := bitpositions(element, 4, 48, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wide, err := bitpositionsWide(element, 4, 48, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wide[0] != def[0] {
+		t.Errorf("bitpositionsWide(%q)[0] = %d, want %d", element, wide[0], def[0])
+	}
+}
+
+func TestWithWideHashing(t *testing.T) {
+	bf, err := New(1000, 0.0001, WithWideHashing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.hashqty != 14 {
+		t.Fatalf("hashqty = %d, want 14", bf.hashqty)
+	}
+
+	for i := 0; i < 1000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if e := []byte(fmt.Sprintf("element%d", i)); !bf.MustHave(e) {
+			t.Errorf("Has(%q) is false, want true", e)
+		}
+	}
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if bf.MustHave([]byte(fmt.Sprintf("absent%d", i))) {
+			fp++
+		}
+	}
+	if fp > 5 {
+		t.Errorf("false positives = %d out of 10000, want about 1", fp)
+	}
+}
+
+func TestNew_probabilityBoundary(t *testing.T) {
+	bf, err := New(1000, 0.99999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.hashqty != 1 {
+		t.Errorf("hashqty = %d, want 1", bf.hashqty)
+	}
+	bf.MustAdd([]byte("test"))
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("Has(%q) is false, want true", "test")
+	}
+}
+
 func TestNew_error(t *testing.T) {
 	tt := []struct {
-		n    uint32
+		n    uint64
 		prob float64
 		want error
 	}{
 		{0, 0.1, ErrZeroElements},
 		{1, 0, ErrProbability},
 		{1, -0.1, ErrProbability},
+		{1, 1, ErrProbabilityRange},
+		{1, 1.5, ErrProbabilityRange},
+		{math.MaxUint64, 0.01, ErrTooManyElements},
+		{1e18, 0.01, ErrTooManyElements},
 	}
 
 	for _, tc := range tt {
@@ -247,10 +537,37 @@ func TestNew_error(t *testing.T) {
 	}
 }
 
+func TestNew_tooManyElements(t *testing.T) {
+	constructors := map[string]func(n uint64, prob float64) error{
+		"NewCascade": func(n uint64, prob float64) error {
+			_, err := NewCascade(n, prob, 2)
+			return err
+		},
+		"NewSafe": func(n uint64, prob float64) error {
+			_, err := NewSafe(n, prob)
+			return err
+		},
+		"NewDedup": func(n uint64, prob float64) error {
+			_, err := NewDedup(n, prob)
+			return err
+		},
+		"NewTimed": func(n uint64, prob float64) error {
+			_, err := NewTimed(n, prob)
+			return err
+		},
+	}
+
+	for name, newFilter := range constructors {
+		if err := newFilter(1e18, 0.01); err != ErrTooManyElements {
+			t.Errorf("%s(1e18, 0.01) error: %q, want %q", name, err, ErrTooManyElements)
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	tt := []struct {
 		name string
-		n    uint32
+		n    uint64
 		prob float64
 		want Filter
 	}{
@@ -341,3 +658,1077 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestFilter_AddsUntilFPR(t *testing.T) {
+	const target = 0.05
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.AddsUntilFPR(1); got != math.MaxInt64 {
+		t.Errorf("AddsUntilFPR(1) = %d, want %d", got, int64(math.MaxInt64))
+	}
+
+	adds := bf.AddsUntilFPR(target)
+	if adds <= 1000 {
+		t.Fatalf("AddsUntilFPR(%f) = %d, want more than capacity", target, adds)
+	}
+	for i := int64(0); i < adds; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+
+	var fp int
+	const queries = 10000
+	for i := 0; i < queries; i++ {
+		if bf.MustHave([]byte(fmt.Sprintf("absent%d", i))) {
+			fp++
+		}
+	}
+	if got := float64(fp) / queries; got < target/2 || got > target*2 {
+		t.Errorf("false positive rate after %d adds = %f, want about %f", adds, got, target)
+	}
+
+	if got := bf.AddsUntilFPR(target / 2); got > 0 {
+		t.Errorf("AddsUntilFPR(%f) = %d, want non-positive", target/2, got)
+	}
+}
+
+func TestFilter_HalfLife(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adds := math.Floor(elementsAtFPR(0.02, bf.hashqty, bf.bitlen))
+	want := time.Duration(adds / 100 * float64(time.Second))
+	if got := bf.HalfLife(100); got != want {
+		t.Errorf("HalfLife(100) = %v, want %v", got, want)
+	}
+	if got := bf.HalfLife(0); got != math.MaxInt64 {
+		t.Errorf("HalfLife(0) = %v, want %v", got, time.Duration(math.MaxInt64))
+	}
+
+	for i := 0; i < int(adds)*2; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	if got := bf.HalfLife(100); got != 0 {
+		t.Errorf("HalfLife(100) of saturated filter = %v, want 0", got)
+	}
+}
+
+func TestFilter_EfficiencyReport(t *testing.T) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bf.EfficiencyReport()
+	want := "bitlen=9585059 allocated=9585088 wasted=29 bits/element=9.585059 theoretical=9585058.38"
+	if got != want {
+		t.Errorf("EfficiencyReport() = %q, want %q", got, want)
+	}
+}
+
+func TestNewFromChan(t *testing.T) {
+	tests := map[string]struct {
+		maxBuffered int
+		elements    int
+		wantDepth   int
+		wantN       uint64
+	}{
+		"empty":           {maxBuffered: 10, elements: 0, wantDepth: 1, wantN: 1},
+		"buffered":        {maxBuffered: 100, elements: 100, wantDepth: 1, wantN: 100},
+		"overflow":        {maxBuffered: 10, elements: 100, wantDepth: 4, wantN: 10},
+		"overflow by one": {maxBuffered: 10, elements: 11, wantDepth: 2, wantN: 10},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			in := make(chan []byte, tc.elements)
+			for i := 0; i < tc.elements; i++ {
+				in <- []byte(fmt.Sprintf("element%d", i))
+			}
+			close(in)
+
+			sf, err := newFromChan(context.Background(), 0.01, in, tc.maxBuffered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sf.QueryDepth(); got != tc.wantDepth {
+				t.Errorf("QueryDepth() = %d, want %d", got, tc.wantDepth)
+			}
+			want, err := New(tc.wantN, sf.sliceProb(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bf := sf.filters[0]
+			if bf.n != want.n || bf.bitlen != want.bitlen || bf.hashqty != want.hashqty {
+				t.Errorf("filters[0] n=%d bitlen=%d hashqty=%d, want n=%d bitlen=%d hashqty=%d", bf.n, bf.bitlen, bf.hashqty, want.n, want.bitlen, want.hashqty)
+			}
+			for i := 0; i < tc.elements; i++ {
+				element := []byte(fmt.Sprintf("element%d", i))
+				if isIn, err := sf.Has(element); err != nil || !isIn {
+					t.Errorf("Has(%q) = %t, %v, want true", element, isIn, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFromChan_error(t *testing.T) {
+	if _, err := NewFromChan(context.Background(), 1, make(chan []byte)); err != ErrProbabilityRange {
+		t.Errorf("NewFromChan(prob=1) error: %q, want %q", err, ErrProbabilityRange)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewFromChan(ctx, 0.01, make(chan []byte)); err != context.Canceled {
+		t.Errorf("NewFromChan(canceled ctx) error: %q, want %q", err, context.Canceled)
+	}
+
+	// The context is checked while draining the elements past the buffer too.
+	ctx, cancel = context.WithCancel(context.Background())
+	in := make(chan []byte)
+	go func() {
+		for i := 0; i < 3; i++ {
+			in <- []byte(fmt.Sprintf("element%d", i))
+		}
+		cancel()
+	}()
+	if _, err := newFromChan(ctx, 0.01, in, 1); err != context.Canceled {
+		t.Errorf("newFromChan(canceled ctx after overflow) error: %q, want %q", err, context.Canceled)
+	}
+}
+
+func TestFilter_SelfCheck(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = make([]byte, 1+r.Intn(32))
+		r.Read(elements[i])
+	}
+	if err = bf.SelfCheck(elements); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilter_SampleFalsePositives(t *testing.T) {
+	const n = 1000
+	const prob = 0.01
+	bf, err := New(n, prob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+
+	const samples = 100000
+	fp := bf.SampleFalsePositives(samples, func(i int) []byte {
+		return []byte(fmt.Sprintf("absent%d", i))
+	})
+	want := samples * prob
+	if got := float64(len(fp)); got < want/2 || got > want*2 {
+		t.Errorf("SampleFalsePositives(%d) returned %d elements, want about %.0f", samples, len(fp), want)
+	}
+	for _, e := range fp {
+		if !bf.MustHave(e) {
+			t.Errorf("Has(%q) is false, want true", e)
+		}
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	m := map[string]int{
+		"alice@example.com": 1,
+		"bob@example.com":   2,
+		"carol@example.com": 3,
+	}
+	bf, err := FromMap(m, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.n != uint64(len(m)) {
+		t.Errorf("FromMap() n = %d, want %d", bf.n, len(m))
+	}
+	for k := range m {
+		if !bf.MustHave([]byte(k)) {
+			t.Errorf("Has(%q) is false, want true", k)
+		}
+	}
+
+	if _, err = FromMap(map[string]struct{}{}, 0.01); err != ErrZeroElements {
+		t.Errorf("FromMap(empty map) error: %q, want %q", err, ErrZeroElements)
+	}
+}
+
+func TestFilter_BitsForAdditional(t *testing.T) {
+	tt := []struct {
+		n    uint64
+		m    uint64
+		want uint64
+	}{
+		{1000000, 0, 9585059},
+		{1000000, 1000000, optimalBitLen(2000000, 0.01)},
+		{2147483647, 2147483648, 41167512252},
+		{4294967295, 1, 41167512262},
+		{math.MaxUint64, 1, math.MaxUint64},
+	}
+
+	for _, tc := range tt {
+		bf := &Filter{n: tc.n, prob: 0.01}
+		got := bf.BitsForAdditional(tc.m)
+		if got != tc.want {
+			t.Errorf("BitsForAdditional(%d) with n=%d = %d, want %d", tc.m, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	a, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	common := []byte("common")
+	onlyA := []byte("a")
+	onlyB := []byte("b")
+	a.MustAdd(common)
+	a.MustAdd(onlyA)
+	b.MustAdd(common)
+	b.MustAdd(onlyB)
+
+	got, err := Intersection(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		element []byte
+		want    bool
+	}{
+		{common, true},
+		{onlyA, false},
+		{onlyB, false},
+	}
+	for _, tc := range tt {
+		if isIn := got.MustHave(tc.element); isIn != tc.want {
+			t.Errorf("Intersection() Has(%q) is %t, want %t", tc.element, isIn, tc.want)
+		}
+	}
+	if !a.MustHave(onlyA) || !b.MustHave(onlyB) {
+		t.Error("Intersection() modified its operands")
+	}
+}
+
+func TestIntersection_error(t *testing.T) {
+	a, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(200, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Intersection(a, b); err != ErrIncompatible {
+		t.Errorf("Intersection() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestFilter_KComparison(t *testing.T) {
+	tt := []struct {
+		bf              Filter
+		wantUsed        byte
+		wantSizeOptimal byte
+	}{
+		{Filter{n: 1, bitlen: 10, hashqty: 7}, 7, 7},
+		{Filter{n: 6, bitlen: 58, hashqty: 7}, 7, 7},
+		{Filter{n: 7, bitlen: 68, hashqty: 7}, 7, 7},
+		{Filter{n: 4294967295, bitlen: 41167512252, hashqty: 7}, 7, 7},
+		{Filter{n: 4294967295, bitlen: 61751268378, hashqty: 10}, 10, 10},
+		{Filter{n: 1000, bitlen: 4793, hashqty: 4}, 4, 3},
+	}
+
+	for _, tc := range tt {
+		used, sizeOptimal := tc.bf.KComparison()
+		if used != tc.wantUsed || sizeOptimal != tc.wantSizeOptimal {
+			t.Errorf("KComparison() with n=%d bitlen=%d = %d, %d, want %d, %d", tc.bf.n, tc.bf.bitlen, used, sizeOptimal, tc.wantUsed, tc.wantSizeOptimal)
+		}
+	}
+}
+
+func TestFilter_AddFixedWidth(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := [][]byte{
+		[]byte("key00001"),
+		[]byte("key00002"),
+		[]byte("key00003"),
+	}
+	r := bytes.NewReader(bytes.Join(keys, nil))
+
+	count, err := bf.AddFixedWidth(r, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != uint64(len(keys)) {
+		t.Errorf("AddFixedWidth() count = %d, want %d", count, len(keys))
+	}
+	for _, k := range keys {
+		if !bf.MustHave(k) {
+			t.Errorf("Has(%q) is false, want true", k)
+		}
+	}
+}
+
+func TestFilter_AddFixedWidth_error(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		input string
+		width int
+		count uint64
+		want  error
+	}{
+		{"key00001key", 8, 1, io.ErrUnexpectedEOF},
+		{"key00001", 0, 0, ErrRecordWidth},
+	}
+
+	for _, tc := range tt {
+		count, err := bf.AddFixedWidth(strings.NewReader(tc.input), tc.width)
+		if err != tc.want || count != tc.count {
+			t.Errorf("AddFixedWidth(%q, %d) = %d, %q, want %d, %q", tc.input, tc.width, count, err, tc.count, tc.want)
+		}
+	}
+}
+
+func TestFilter_HasWithBudget(t *testing.T) {
+	bf := &Filter{
+		hashqty:  4,
+		bitlen:   48,
+		bitstore: []uint64{1<<38 | 1<<47}, // "test" first two bit positions: 38, 47.
+	}
+
+	tt := []struct {
+		element      string
+		maxPositions int
+		wantIsIn     bool
+		wantOk       bool
+	}{
+		{"test", 0, true, false},
+		{"test", 1, true, false},
+		{"test", 2, true, false},
+		{"test", 3, false, true},
+		{"test", 4, false, true},
+		{"test", 10, false, true},
+	}
+
+	for _, tc := range tt {
+		isIn, ok, err := bf.HasWithBudget([]byte(tc.element), tc.maxPositions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isIn != tc.wantIsIn || ok != tc.wantOk {
+			t.Errorf("HasWithBudget(%q, %d) = %t, %t, want %t, %t", tc.element, tc.maxPositions, isIn, ok, tc.wantIsIn, tc.wantOk)
+		}
+	}
+
+	bf.bitstore[0] = 141063905869824 // All "test" bit positions are set.
+	isIn, ok, err := bf.HasWithBudget([]byte("test"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isIn || !ok {
+		t.Errorf("HasWithBudget(%q, 4) = %t, %t, want true, true", "test", isIn, ok)
+	}
+}
+
+func TestFilter_Fold(t *testing.T) {
+	for _, modulo := range []bool{false, true} {
+		bf, err := New(1000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A filter decoded from the encodings before version 3 reduces hashes with modulo.
+		bf.reduceModulo = modulo
+		for i := 0; i < 1000; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		}
+
+		for _, factor := range []int{1, 2, 4793} {
+			folded, err := bf.Fold(factor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bf.bitlen / uint64(factor); folded.bitlen != want {
+				t.Errorf("Fold(%d) bitlen = %d, want %d", factor, folded.bitlen, want)
+			}
+			for i := 0; i < 1000; i++ {
+				element := []byte(fmt.Sprintf("element%d", i))
+				if !folded.MustHave(element) {
+					t.Errorf("Fold(%d) modulo=%t Has(%q) is false, want true", factor, modulo, element)
+				}
+			}
+		}
+	}
+}
+
+func TestFilter_Fold_error(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, factor := range []int{-1, 0, 3} {
+		if _, err = bf.Fold(factor); err != ErrFoldFactor {
+			t.Errorf("Fold(%d) error: %q, want %q", factor, err, ErrFoldFactor)
+		}
+	}
+}
+
+func TestUnionContributions(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 600; i++ {
+		a.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	for i := 400; i < 1000; i++ {
+		b.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+
+	counts, union, err := UnionContributions(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	within := func(got, want uint64) bool {
+		return math.Abs(float64(got)-float64(want)) <= float64(want)*0.05
+	}
+	if len(counts) != 2 || !within(counts[0], 600) || !within(counts[1], 600) {
+		t.Errorf("UnionContributions() counts = %v, want about [600 600]", counts)
+	}
+	if !within(union, 1000) {
+		t.Errorf("UnionContributions() union = %d, want about 1000", union)
+	}
+
+	// Bits beyond bitlen are not counted.
+	x := &Filter{hashqty: 4, bitlen: 48, bitstore: []uint64{0xffff00000000000f}}
+	y := &Filter{hashqty: 4, bitlen: 48, bitstore: []uint64{0xffff0000000000f0}}
+	xy := &Filter{hashqty: 4, bitlen: 48, bitstore: []uint64{0xff}}
+	counts, union, err = UnionContributions(x, y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := x.EstimateCount(); counts[0] != want || counts[1] != want || union != xy.EstimateCount() {
+		t.Errorf("UnionContributions() = %v, %d, want [%d %d], %d", counts, union, want, want, xy.EstimateCount())
+	}
+
+	c, err := New(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = UnionContributions(a, c); err != ErrIncompatible {
+		t.Errorf("UnionContributions() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestFilter_ShardOf(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	// The first bit position of "test" is 38 which is bitposition("test\x00", 48).
+	if got, err := bf.ShardOf([]byte("test"), 48); err != nil || got != 38 {
+		t.Errorf("ShardOf(%q, 48) = %d, %v, want 38, <nil>", "test", got, err)
+	}
+
+	const shards = 8
+	const elements = 10000
+	counts := make([]int, shards)
+	for i := 0; i < elements; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		s1, err := bf.ShardOf(element, shards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s2, err := bf.ShardOf(element, shards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s1 != s2 {
+			t.Fatalf("ShardOf(%q) = %d, then %d", element, s1, s2)
+		}
+		counts[s1]++
+	}
+	for shard, c := range counts {
+		if want := elements / shards; math.Abs(float64(c-want)) > float64(want)*0.1 {
+			t.Errorf("shard %d got %d elements, want about %d", shard, c, want)
+		}
+	}
+
+	// WithDoubleHashing the first position is derived from the hash of the element itself.
+	bf.derivation = deriveDouble
+	pos, err := doublepositions([]byte("test"), bf.hashqty, bf.bitlen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bf.ShardOf([]byte("test"), 48); err != nil || uint64(got) != pos[0] {
+		t.Errorf("ShardOf(%q, 48) WithDoubleHashing = %d, %v, want %d, <nil>", "test", got, err, pos[0])
+	}
+
+	// The first bit position of "test" reduced with modulo is 7.
+	bf = &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1), reduceModulo: true}
+	if got, err := bf.ShardOf([]byte("test"), 48); err != nil || got != 7 {
+		t.Errorf("ShardOf(%q, 48) with modulo reduction = %d, %v, want 7, <nil>", "test", got, err)
+	}
+
+	if _, err := bf.ShardOf([]byte("test"), 0); err != ErrShards {
+		t.Errorf("ShardOf(%q, 0) error: %q, want %q", "test", err, ErrShards)
+	}
+}
+
+func TestFilter_ExpectedFalsePositivesPerSec(t *testing.T) {
+	bf := &Filter{
+		hashqty:  2,
+		bitlen:   64,
+		bitstore: []uint64{0xFFFFFFFF}, // Half of the bits are set, so FPR is 0.25.
+	}
+
+	tt := []struct {
+		qps            float64
+		absentFraction float64
+		want           float64
+	}{
+		{1000, 0.5, 125},
+		{1000, 1, 250},
+		{1000, 0, 0},
+		{0, 0.5, 0},
+	}
+
+	for _, tc := range tt {
+		got := bf.ExpectedFalsePositivesPerSec(tc.qps, tc.absentFraction)
+		if got != tc.want {
+			t.Errorf("ExpectedFalsePositivesPerSec(%f, %f) = %f, want %f", tc.qps, tc.absentFraction, got, tc.want)
+		}
+	}
+}
+
+func TestFilter_PrecomputePositions(t *testing.T) {
+	elements := [][]byte{[]byte("test"), []byte("test1"), []byte("test2")}
+	want := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	for _, e := range elements {
+		want.MustAdd(e)
+	}
+
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	positions, err := bf.PrecomputePositions(elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.bitstore[0] != 0 {
+		t.Fatal("PrecomputePositions() modified the filter")
+	}
+	if !equal(positions[0], []uint64{38, 47, 35, 34}) {
+		t.Errorf("PrecomputePositions() %q = %v, want %v", elements[0], positions[0], []uint64{38, 47, 35, 34})
+	}
+
+	bf.AddPositions(positions)
+	if !equal(bf.bitstore, want.bitstore) {
+		t.Errorf("AddPositions() bitstore = %v, want %v", bf.bitstore, want.bitstore)
+	}
+}
+
+func TestFilter_Digest(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	for _, element := range []string{"test", ""} {
+		want := sha256.Sum256(append([]byte(element), 0))
+		if got := bf.Digest([]byte(element)); !bytes.Equal(got, want[:]) {
+			t.Errorf("Digest(%q) = %x, want %x", element, got, want)
+		}
+	}
+}
+
+func TestFilter_TryAdd(t *testing.T) {
+	const n = 1000
+	bf, err := New(n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added int
+	for i := 0; i < 2*n; i++ {
+		ok, err := bf.TryAdd([]byte(fmt.Sprintf("element%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		added++
+	}
+	// The filter rounds hashqty up which makes FPR reach the probability just before the capacity.
+	if added < n*99/100 || added > n {
+		t.Errorf("TryAdd() added %d elements, want about %d", added, n)
+	}
+
+	ok, err := bf.TryAdd([]byte("element"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("TryAdd() added an element past the capacity")
+	}
+	for i := 0; i < added; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if !bf.MustHave(element) {
+			t.Errorf("Has(%q) is false, want true", element)
+		}
+	}
+}
+
+func TestFilter_getters(t *testing.T) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.Cap(); got != 1000000 {
+		t.Errorf("Cap() = %d, want 1000000", got)
+	}
+	if got := bf.BitLen(); got != 9585059 {
+		t.Errorf("BitLen() = %d, want 9585059", got)
+	}
+	if got := bf.HashCount(); got != 7 {
+		t.Errorf("HashCount() = %d, want 7", got)
+	}
+	if got := bf.Probability(); got != 0.01 {
+		t.Errorf("Probability() = %f, want 0.01", got)
+	}
+}
+
+func TestFilter_String(t *testing.T) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Bloom(n=1000000, p=0.010000, m=9585059 bits, k=7, fill=0.0%)"
+	if got := fmt.Sprintf("%s", bf); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	bf = &Filter{n: 1, prob: 0.5, hashqty: 4, bitlen: 48, bitstore: []uint64{0xffffff}}
+	want = "Bloom(n=1, p=0.500000, m=48 bits, k=4, fill=50.0%)"
+	if got := bf.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { _ = bf.String() }); allocs > 1 {
+		t.Errorf("String() allocs = %f, want at most 1", allocs)
+	}
+}
+
+func TestFilter_MaxElementLen(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		element string
+		want    int
+	}{
+		{"", 0},
+		{"test", 4},
+		{"alice@example.com", 17},
+		{"bob", 17},
+	}
+
+	for _, tc := range tt {
+		bf.MustAdd([]byte(tc.element))
+		if got := bf.MaxElementLen(); got != tc.want {
+			t.Errorf("MaxElementLen() after Add(%q) = %d, want %d", tc.element, got, tc.want)
+		}
+	}
+	bf.MustHave([]byte("a very long element which is not added"))
+	if got := bf.MaxElementLen(); got != 17 {
+		t.Errorf("MaxElementLen() after Has = %d, want 17", got)
+	}
+}
+
+func TestFilter_RepairBitstore(t *testing.T) {
+	tt := []struct {
+		name     string
+		bitstore []uint64
+		want     []uint64
+	}{
+		{"short", []uint64{1}, []uint64{1, 0}},
+		{"empty", nil, []uint64{0, 0}},
+		{"intact", []uint64{1, 2}, []uint64{1, 2}},
+		{"long", []uint64{1, 2, 0, 0}, []uint64{1, 2}},
+	}
+
+	for _, tc := range tt {
+		bf := &Filter{hashqty: 4, bitlen: 68, bitstore: tc.bitstore}
+		if err := bf.RepairBitstore(); err != nil {
+			t.Errorf("RepairBitstore(%s) error: %q", tc.name, err)
+			continue
+		}
+		if !equal(bf.bitstore, tc.want) {
+			t.Errorf("RepairBitstore(%s) bitstore = %v, want %v", tc.name, bf.bitstore, tc.want)
+		}
+	}
+}
+
+func TestFilter_RepairBitstore_error(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 68, bitstore: []uint64{1, 2, 0, 3}}
+	if err := bf.RepairBitstore(); err != ErrBitstoreExcess {
+		t.Errorf("RepairBitstore() error: %q, want %q", err, ErrBitstoreExcess)
+	}
+	if want := []uint64{1, 2, 0, 3}; !equal(bf.bitstore, want) {
+		t.Errorf("RepairBitstore() bitstore = %v, want %v", bf.bitstore, want)
+	}
+}
+
+func TestFilter_PackPositions(t *testing.T) {
+	element := []byte("test")
+	want := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	want.MustAdd(element)
+
+	packed, err := want.PackPositions(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bit positions: 38, 47, 35, 34
+	if wantPacked := []byte{38, 47, 35, 34}; !bytes.Equal(packed, wantPacked) {
+		t.Errorf("PackPositions(%q) = %v, want %v", element, packed, wantPacked)
+	}
+
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	if err = bf.ApplyPackedPositions(packed); err != nil {
+		t.Fatal(err)
+	}
+	if !equal(bf.bitstore, want.bitstore) || bf.count != 1 {
+		t.Errorf("ApplyPackedPositions() bitstore = %v, count = %d, want %v, 1", bf.bitstore, bf.count, want.bitstore)
+	}
+
+	// Packed positions of two elements.
+	other, err := want.PackPositions([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.MustAdd([]byte("other"))
+	bf = &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	if err = bf.ApplyPackedPositions(append(packed, other...)); err != nil {
+		t.Fatal(err)
+	}
+	if !equal(bf.bitstore, want.bitstore) || bf.count != 2 {
+		t.Errorf("ApplyPackedPositions() of two elements bitstore = %v, count = %d, want %v, 2", bf.bitstore, bf.count, want.bitstore)
+	}
+}
+
+func TestFilter_ApplyPackedPositions_error(t *testing.T) {
+	tt := []struct {
+		name   string
+		packed []byte
+	}{
+		{"out of range", []byte{7, 48}},
+		{"truncated varint", []byte{7, 0x80}},
+		{"partial element", []byte{38, 47, 35}},
+		{"partial second element", []byte{38, 47, 35, 34, 7}},
+	}
+
+	for _, tc := range tt {
+		bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+		if err := bf.ApplyPackedPositions(tc.packed); err != ErrPackedPositions {
+			t.Errorf("ApplyPackedPositions(%s) error: %q, want %q", tc.name, err, ErrPackedPositions)
+		}
+		if bf.bitstore[0] != 0 || bf.count != 0 {
+			t.Errorf("ApplyPackedPositions(%s) modified the filter", tc.name)
+		}
+	}
+}
+
+func TestFilter_Reset(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	bitstore := bf.bitstore
+
+	bf.Reset()
+	for i := 0; i < 100; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if bf.MustHave(element) {
+			t.Errorf("Has(%q) after Reset is true, want false", element)
+		}
+	}
+	if bf.n != 100 || bf.prob != 0.01 || bf.bitlen != 959 || bf.hashqty != 7 {
+		t.Errorf("Reset() changed parameters: n=%d prob=%f bitlen=%d hashqty=%d", bf.n, bf.prob, bf.bitlen, bf.hashqty)
+	}
+	if &bitstore[0] != &bf.bitstore[0] || len(bitstore) != len(bf.bitstore) {
+		t.Error("Reset() reallocated the bitstore")
+	}
+	if bf.count != 0 || bf.MaxElementLen() != 0 {
+		t.Errorf("Reset() count = %d, max element len = %d, want 0, 0", bf.count, bf.MaxElementLen())
+	}
+}
+
+func TestFilter_Clone(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.MustAdd([]byte("alice"))
+
+	clone := bf.Clone()
+	if clone.prob != bf.prob || clone.bitlen != bf.bitlen || clone.hashqty != bf.hashqty || clone.n != bf.n || clone.count != bf.count {
+		t.Errorf("Clone() = %+v, want %+v", clone, bf)
+	}
+	if !clone.MustHave([]byte("alice")) {
+		t.Errorf("Clone() Has(%q) is false, want true", "alice")
+	}
+
+	clone.MustAdd([]byte("bob"))
+	bf.MustAdd([]byte("carol"))
+	if bf.MustHave([]byte("bob")) {
+		t.Errorf("source Has(%q) is true, want false", "bob")
+	}
+	if clone.MustHave([]byte("carol")) {
+		t.Errorf("Clone() Has(%q) is true, want false", "carol")
+	}
+}
+
+func TestFilter_Swap(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.MustAdd([]byte("alice"))
+
+	snapshot := bf.Swap()
+	if !snapshot.MustHave([]byte("alice")) {
+		t.Errorf("Swap() snapshot Has(%q) is false, want true", "alice")
+	}
+	if bf.SetBits() != 0 {
+		t.Error("Swap() left bits set in the filter")
+	}
+
+	bf.MustAdd([]byte("bob"))
+	if snapshot.MustHave([]byte("bob")) {
+		t.Errorf("Swap() snapshot Has(%q) is true, want false", "bob")
+	}
+}
+
+func TestFilter_Intersect(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		a.MustAdd([]byte(fmt.Sprintf("common%d", i)))
+		b.MustAdd([]byte(fmt.Sprintf("common%d", i)))
+		a.MustAdd([]byte(fmt.Sprintf("a%d", i)))
+		b.MustAdd([]byte(fmt.Sprintf("b%d", i)))
+	}
+
+	if err = a.Intersect(b); err != nil {
+		t.Fatal(err)
+	}
+	var dropped int
+	for i := 0; i < 300; i++ {
+		if element := []byte(fmt.Sprintf("common%d", i)); !a.MustHave(element) {
+			t.Errorf("Intersect() Has(%q) is false, want true", element)
+		}
+		if !a.MustHave([]byte(fmt.Sprintf("a%d", i))) {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Error("Intersect() kept all elements unique to one filter")
+	}
+
+	if err = a.Intersect(&Filter{bitlen: 10}); err != ErrIncompatible {
+		t.Errorf("Intersect() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestFilter_NewBitsSince(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	bf.MustAdd([]byte("test"))
+
+	snapshot := bf.Bits()
+	// "test" bit positions: 38, 47, 35, 34.
+	if want := []uint64{141063905869824}; !equal(snapshot, want) {
+		t.Errorf("Bits() = %v, want %v", snapshot, want)
+	}
+	snapshot[0] = 0
+	if bf.bitstore[0] == 0 {
+		t.Error("Bits() didn't copy the bitstore")
+	}
+
+	snapshot = bf.Bits()
+	bf.MustAdd([]byte("test1"))
+	got, err := bf.NewBitsSince(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(bits.OnesCount64(bf.bitstore[0])) - uint64(bits.OnesCount64(snapshot[0]))
+	if got != want || got == 0 {
+		t.Errorf("NewBitsSince() = %d, want %d", got, want)
+	}
+
+	if _, err = bf.NewBitsSince(nil); err != ErrSnapshotLength {
+		t.Errorf("NewBitsSince(nil) error: %q, want %q", err, ErrSnapshotLength)
+	}
+}
+
+func TestFilter_AddAtomic(t *testing.T) {
+	bf, err := New(10000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Goroutines add overlapping elements to exercise concurrent OR on the same buckets,
+	// while other goroutines look the elements up.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if _, err := bf.HasAtomic([]byte(fmt.Sprintf("element%d", i))); err != nil {
+					t.Errorf("HasAtomic() error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if err := bf.AddAtomic([]byte(fmt.Sprintf("element%d", i))); err != nil {
+					t.Errorf("AddAtomic() error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 1000; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if isIn, err := bf.HasAtomic(element); err != nil || !isIn {
+			t.Errorf("HasAtomic(%q) = %t, %v, want true", element, isIn, err)
+		}
+	}
+	if bf.count != 16000 {
+		t.Errorf("count = %d, want 16000", bf.count)
+	}
+
+	want, err := New(10000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		want.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	for i := range want.bitstore {
+		if bf.bitstore[i] != want.bitstore[i] {
+			t.Fatalf("bitstore[%d] = %x, want %x", i, bf.bitstore[i], want.bitstore[i])
+		}
+	}
+}
+
+func TestFilter_AddString(t *testing.T) {
+	a := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	b := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	for _, s := range []string{"", "test", strings.Repeat("long", 50)} {
+		if err := a.AddString(s); err != nil {
+			t.Fatal(err)
+		}
+		b.MustAdd([]byte(s))
+		if a.bitstore[0] != b.bitstore[0] {
+			t.Errorf("AddString(%q) bitstore = %x, want %x", s, a.bitstore[0], b.bitstore[0])
+		}
+		if isIn, err := a.HasString(s); err != nil || !isIn {
+			t.Errorf("HasString(%q) = %t, %v, want true", s, isIn, err)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(10, func() { a.HasString("test") }); allocs > 1 {
+		t.Errorf("HasString() allocs = %f, want at most 1", allocs)
+	}
+}
+
+func TestFilter_TestAndAdd(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}
+	element := []byte("test")
+
+	wasIn, err := bf.TestAndAdd(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wasIn {
+		t.Errorf("first TestAndAdd(%q) = true, want false", element)
+	}
+	if want := uint64(141063905869824); bf.bitstore[0] != want {
+		t.Errorf("TestAndAdd(%q) bitstore = %d, want %d", element, bf.bitstore[0], want)
+	}
+
+	if wasIn, err = bf.TestAndAdd(element); err != nil {
+		t.Fatal(err)
+	}
+	if !wasIn {
+		t.Errorf("second TestAndAdd(%q) = false, want true", element)
+	}
+	if bf.count != 2 {
+		t.Errorf("count = %d, want 2", bf.count)
+	}
+}
+
+func TestFilter_AddAll(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = []byte(fmt.Sprintf("element%d", i))
+	}
+	if err = bf.AddAll(elements); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range elements {
+		if !bf.MustHave(e) {
+			t.Errorf("Has(%q) is false, want true", e)
+		}
+	}
+	if bf.count != 1000 {
+		t.Errorf("count = %d, want 1000", bf.count)
+	}
+
+	bf, err = New(1000, 0.01, WithHasher(func() hash.Hash { return fnv.New32a() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bf.AddAll(elements); err != ErrHashSize {
+		t.Errorf("AddAll() error: %v, want %q", err, ErrHashSize)
+	}
+}
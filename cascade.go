@@ -0,0 +1,55 @@
+package bloom
+
+// CascadeFilter is a chain of independent Bloom filters which reports an element only if all of them do.
+// Stages use different seeds, so their false positives are independent, and the probability of false positives
+// drops to prob^stages. The cost is stages times the memory, and a lookup hashes an element once per stage.
+// Operations are not concurrency safe.
+type CascadeFilter struct {
+	stages []*Filter
+}
+
+// NewCascade creates a cascade of stages filters for n elements each with prob probability of false positives.
+// The number of stages must be in [1, 255] range, otherwise ErrStages is returned.
+func NewCascade(n uint64, prob float64, stages int) (*CascadeFilter, error) {
+	if stages < 1 || stages > 255 {
+		return nil, ErrStages
+	}
+	cf := CascadeFilter{
+		stages: make([]*Filter, stages),
+	}
+	for i := range cf.stages {
+		bf, err := New(n, prob)
+		if err != nil {
+			return nil, err
+		}
+		cf.stages[i] = bf
+	}
+	return &cf, nil
+}
+
+// Add adds an element to all the stages.
+func (cf *CascadeFilter) Add(element []byte) error {
+	seeded := make([]byte, len(element)+1)
+	copy(seeded[1:], element)
+	for i, bf := range cf.stages {
+		seeded[0] = byte(i)
+		if err := bf.Add(seeded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Has tests if the element is in the set, i.e., all the stages report it.
+func (cf *CascadeFilter) Has(element []byte) (bool, error) {
+	seeded := make([]byte, len(element)+1)
+	copy(seeded[1:], element)
+	for i, bf := range cf.stages {
+		seeded[0] = byte(i)
+		isIn, err := bf.Has(seeded)
+		if err != nil || !isIn {
+			return false, err
+		}
+	}
+	return true, nil
+}
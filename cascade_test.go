@@ -0,0 +1,69 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCascadeFilter(t *testing.T) {
+	const n = 1000
+	const prob = 0.1
+	const stages = 2
+	cf, err := NewCascade(n, prob, stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err = cf.Add([]byte(fmt.Sprintf("element%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		isIn, err := cf.Has(element)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isIn {
+			t.Errorf("Has(%q) is false, want true", element)
+		}
+	}
+
+	const queries = 20000
+	var fp int
+	for i := 0; i < queries; i++ {
+		isIn, err := cf.Has([]byte(fmt.Sprintf("absent%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isIn {
+			fp++
+		}
+	}
+	want := math.Pow(prob, stages)
+	if got := float64(fp) / queries; got < want/2 || got > want*2 {
+		t.Errorf("false positive rate = %f, want about %f", got, want)
+	}
+}
+
+func TestNewCascade_error(t *testing.T) {
+	tt := []struct {
+		n      uint64
+		prob   float64
+		stages int
+		want   error
+	}{
+		{100, 0.1, 0, ErrStages},
+		{100, 0.1, 256, ErrStages},
+		{0, 0.1, 2, ErrZeroElements},
+		{100, 0, 2, ErrProbability},
+	}
+
+	for _, tc := range tt {
+		if _, err := NewCascade(tc.n, tc.prob, tc.stages); err != tc.want {
+			t.Errorf("NewCascade(%d, %f, %d) error: %q, want %q", tc.n, tc.prob, tc.stages, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package bloom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteCHeader writes the filter to w as a C header, so a prebuilt filter can be compiled into a non-Go program.
+// The header defines <SYMBOL>_BITLEN, <SYMBOL>_HASHQTY, <SYMBOL>_BUCKETS, <SYMBOL>_REDUCE_MODULO macros
+// and a static const uint64_t array named symbol holding the bitstore buckets.
+//
+// To query the filter, the C side must derive bit positions exactly as the package does:
+// for each i from 0 to HASHQTY-1, compute sha256 of the element bytes followed by a single byte i,
+// interpret the first 8 bytes of the digest as a big-endian uint64 x, and take the high 64 bits
+// of the 128-bit product x*BITLEN, e.g., (uint64_t)(((unsigned __int128)x * BITLEN) >> 64),
+// or x % BITLEN if REDUCE_MODULO is 1 (a filter decoded from the encodings before version 3).
+// Position p is set when bit p%64 of bucket p/64 is one.
+// The element is in the set if all HASHQTY bits are set.
+// If the filter was created WithHasher, the C side must use that hash function instead of SHA-256,
+// and WithDoubleHashing or WithWideHashing it must derive the positions as described there.
+//
+// ErrSymbol is returned when symbol is not a valid C identifier.
+func (bf *Filter) WriteCHeader(w io.Writer, symbol string) error {
+	if !isCIdent(symbol) {
+		return ErrSymbol
+	}
+
+	macro := strings.ToUpper(symbol)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#ifndef %s_H\n#define %s_H\n\n", macro, macro)
+	fmt.Fprint(bw, "#include <stdint.h>\n\n")
+	fmt.Fprintf(bw, "#define %s_BITLEN %dULL\n", macro, bf.bitlen)
+	fmt.Fprintf(bw, "#define %s_HASHQTY %d\n", macro, bf.hashqty)
+	fmt.Fprintf(bw, "#define %s_BUCKETS %d\n", macro, len(bf.bitstore))
+	var modulo int
+	if bf.reduceModulo {
+		modulo = 1
+	}
+	fmt.Fprintf(bw, "#define %s_REDUCE_MODULO %d\n\n", macro, modulo)
+
+	fmt.Fprintf(bw, "static const uint64_t %s[%s_BUCKETS] = {", symbol, macro)
+	for i, bucket := range bf.bitstore {
+		if i%4 == 0 {
+			fmt.Fprint(bw, "\n\t")
+		} else {
+			fmt.Fprint(bw, " ")
+		}
+		fmt.Fprintf(bw, "0x%016xULL,", bucket)
+	}
+	fmt.Fprintf(bw, "\n};\n\n#endif /* %s_H */\n", macro)
+	return bw.Flush()
+}
+
+// isCIdent reports whether s is a valid C identifier.
+func isCIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && '0' <= c && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package bloom
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilter_WriteCHeader(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.MustAdd([]byte("fizz"))
+
+	var buf bytes.Buffer
+	if err = bf.WriteCHeader(&buf, "my_filter"); err != nil {
+		t.Fatal(err)
+	}
+	header := buf.String()
+
+	for _, want := range []string{
+		"#define MY_FILTER_BITLEN 959ULL\n",
+		"#define MY_FILTER_HASHQTY 7\n",
+		"#define MY_FILTER_BUCKETS 15\n",
+		"#define MY_FILTER_REDUCE_MODULO 0\n",
+		"static const uint64_t my_filter[MY_FILTER_BUCKETS] = {",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("WriteCHeader() = %s, want it to contain %q", header, want)
+		}
+	}
+	if got := strings.Count(header, "ULL,"); got != len(bf.bitstore) {
+		t.Errorf("WriteCHeader() has %d buckets, want %d", got, len(bf.bitstore))
+	}
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("C compiler is not found")
+	}
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "my_filter.h"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "main.c")
+	prog := `#include "my_filter.h"
+int main(void) {
+	_Static_assert(MY_FILTER_BITLEN == 959ULL, "bitlen");
+	_Static_assert(MY_FILTER_HASHQTY == 7, "hashqty");
+	return sizeof(my_filter) == MY_FILTER_BUCKETS * 8 ? 0 : 1;
+}
+`
+	if err = os.WriteFile(src, []byte(prog), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(cc, "-std=c11", "-Wall", "-Werror", "-fsyntax-only", src).CombinedOutput()
+	if err != nil {
+		t.Errorf("cc error: %v\n%s", err, out)
+	}
+}
+
+func TestFilter_WriteCHeader_error(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, symbol := range []string{"", "1filter", "my-filter", "фильтр"} {
+		if err = bf.WriteCHeader(&bytes.Buffer{}, symbol); err != ErrSymbol {
+			t.Errorf("WriteCHeader(%q) error: %q, want %q", symbol, err, ErrSymbol)
+		}
+	}
+}
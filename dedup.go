@@ -0,0 +1,45 @@
+package bloom
+
+// DedupFilter is a Bloom filter which counts duplicate insertions, e.g., to measure a dedup rate of a stream.
+// Note, the duplicate count includes false positives: an element that wasn't added before
+// is counted as a duplicate with the filter's probability of false positives, so the count overestimates
+// real duplicates, increasingly so as the filter fills up.
+// Operations are not concurrency safe.
+type DedupFilter struct {
+	filter *Filter
+	// duplicates is a number of Add calls for elements that were probably already present.
+	duplicates uint64
+}
+
+// NewDedup creates a new dedup Bloom filter for n elements
+// based on tolerated error rate of false positives, see New.
+func NewDedup(n uint64, prob float64) (*DedupFilter, error) {
+	bf, err := New(n, prob)
+	if err != nil {
+		return nil, err
+	}
+	return &DedupFilter{filter: bf}, nil
+}
+
+// Add adds the element to the set and reports whether it was probably already present.
+// It panics if the element can't be hashed similar to MustAdd.
+func (df *DedupFilter) Add(element []byte) (isDuplicate bool) {
+	isDuplicate, err := df.filter.TestAndAdd(element)
+	if err != nil {
+		panic(err)
+	}
+	if isDuplicate {
+		df.duplicates++
+	}
+	return isDuplicate
+}
+
+// Has tests if the element is in the set.
+func (df *DedupFilter) Has(element []byte) (bool, error) {
+	return df.filter.Has(element)
+}
+
+// DuplicateCount returns how many Add calls were for elements that were probably already present.
+func (df *DedupFilter) DuplicateCount() uint64 {
+	return df.duplicates
+}
@@ -0,0 +1,41 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDedupFilter(t *testing.T) {
+	df, err := NewDedup(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if df.Add(element) {
+			t.Errorf("Add(%q) is duplicate, want new", element)
+		}
+	}
+	if got := df.DuplicateCount(); got != 0 {
+		t.Errorf("DuplicateCount() = %d, want 0", got)
+	}
+
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < 100; i++ {
+			element := []byte(fmt.Sprintf("element%d", i))
+			if !df.Add(element) {
+				t.Errorf("Add(%q) is new, want duplicate", element)
+			}
+		}
+		if got, want := df.DuplicateCount(), uint64(round*100); got != want {
+			t.Errorf("DuplicateCount() = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestNewDedup_error(t *testing.T) {
+	if _, err := NewDedup(0, 0.01); err != ErrZeroElements {
+		t.Errorf("NewDedup(0, 0.01) error: %q, want %q", err, ErrZeroElements)
+	}
+}
@@ -0,0 +1,247 @@
+package bloom
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// AdversarialFillRatio demonstrates why a non-keyed hash function matters for adversarial inputs.
+// Knowing the default SHA-256 hashing, an attacker can brute-force elements whose bit positions
+// all fall into the lower half of the bit array. AdversarialFillRatio tries attempts such candidates,
+// adds the matching ones into a copy of the filter (the filter itself is not modified),
+// and returns the fraction of set bits that ended up in the attacked half.
+// The evenly spread fill is about 0.5, whereas 1 means all the bits are concentrated in the attacked half,
+// where false positives become more likely than the filter's probability suggests.
+func (bf *Filter) AdversarialFillRatio(attempts int) float64 {
+	bitstore := make([]uint64, len(bf.bitstore))
+	copy(bitstore, bf.bitstore)
+
+	half := bf.bitlen / 2
+	var candidate []byte
+	for i := 0; i < attempts; i++ {
+		candidate = strconv.AppendInt(candidate[:0], int64(i), 10)
+		pos, err := bf.positions(candidate, bf.hashqty)
+		if err != nil {
+			continue
+		}
+		if !allBelow(pos, half) {
+			continue
+		}
+
+		for _, p := range pos {
+			index, offset := bitlocation(p, 64)
+			bitstore[index] |= 1 << offset
+		}
+	}
+
+	var total, attacked uint64
+	index, offset := bitlocation(half, 64)
+	for i, b := range bitstore {
+		c := uint64(bits.OnesCount64(b))
+		total += c
+		switch {
+		case i < index:
+			attacked += c
+		case i == index:
+			attacked += uint64(bits.OnesCount64(b & (1<<offset - 1)))
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(attacked) / float64(total)
+}
+
+// allBelow reports whether all the positions are less than limit.
+func allBelow(pos []uint64, limit uint64) bool {
+	for _, p := range pos {
+		if p >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSingleBucket reports whether all bit positions of the element fall into the same uint64 bucket
+// which means a lookup touches a single word of memory.
+func (bf *Filter) IsSingleBucket(element []byte) (bool, error) {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return false, err
+	}
+	if len(pos) == 0 {
+		return true, nil
+	}
+
+	first, _ := bitlocation(pos[0], 64)
+	for _, p := range pos[1:] {
+		if index, _ := bitlocation(p, 64); index != first {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CacheLinesTouched returns how many distinct 64 bytes (512 bits) cache lines the element's bit positions span.
+// It quantifies the memory access cost of a lookup which is about hashqty cache lines for large filters.
+func (bf *Filter) CacheLinesTouched(element []byte) (int, error) {
+	pos, err := bf.positions(element, bf.hashqty)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := make(map[uint64]struct{}, len(pos))
+	for _, p := range pos {
+		lines[p/512] = struct{}{}
+	}
+	return len(lines), nil
+}
+
+// TestVector describes bit positions of an element under the filter's parameters.
+// Vectors are meant to verify that other implementations address elements identically.
+type TestVector struct {
+	// Element is the hashed element.
+	Element []byte
+	// BitLen is the length of the bit array.
+	BitLen uint64
+	// HashQty is the number of hash functions.
+	HashQty byte
+	// Derivation is how positions are derived from the element's hashes, encoded as in MarshalBinary:
+	// 0 is a hash per position, 1 is double hashing (WithDoubleHashing), 2 is wide hashing (WithWideHashing).
+	Derivation byte
+	// ReduceModulo is set when hashes are reduced to positions with modulo bitlen
+	// instead of Lemire's reduction, see LoadWithMigration.
+	ReduceModulo bool
+	// Positions are the element's bit positions, one per hash function.
+	Positions []uint64
+}
+
+// TestVectors returns a test vector for each element.
+// Positions are nil for an element that failed to be hashed.
+func (bf *Filter) TestVectors(elements [][]byte) []TestVector {
+	vv := make([]TestVector, len(elements))
+	for i, e := range elements {
+		vv[i] = TestVector{
+			Element:      e,
+			BitLen:       bf.bitlen,
+			HashQty:      bf.hashqty,
+			Derivation:   byte(bf.derivation),
+			ReduceModulo: bf.reduceModulo,
+		}
+		if pos, err := bf.positions(e, bf.hashqty); err == nil {
+			vv[i].Positions = pos
+		}
+	}
+	return vv
+}
+
+// SampleSetBits returns positions of a pseudo-random sample of set bits in ascending order,
+// roughly fraction of all the set bits.
+// A position is sampled when its hash (splitmix64 with a fixed seed) falls under the fraction of the hash range.
+// Therefore the sample is deterministic: the same filter always yields the same sample,
+// and filters that share set bits tend to share sampled positions, e.g., to build compact signatures for similarity comparison.
+func (bf *Filter) SampleSetBits(fraction float64) []uint64 {
+	var sample []uint64
+	if fraction <= 0 {
+		return sample
+	}
+	threshold := uint64(math.MaxUint64)
+	if fraction < 1 {
+		threshold = uint64(fraction * math.MaxUint64)
+	}
+	bf.eachSetBit(func(p uint64) {
+		if splitmix64(p^sampleSeed) <= threshold {
+			sample = append(sample, p)
+		}
+	})
+	return sample
+}
+
+// sampleSeed is a fixed seed for SampleSetBits to keep samples reproducible.
+const sampleSeed = 0x5bd1e995
+
+// splitmix64 mixes x into a well distributed 64 bit hash.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// HotPositions returns up to topN bit positions hit by the most elements in the sample,
+// ordered from the hottest one (ties are broken by lower position first).
+// Hotspots indicate hash skew which concentrates many elements on few bits and inflates the false positive rate,
+// that could justify switching the hash function or increasing bitlen.
+// Elements that fail to be hashed are skipped.
+func (bf *Filter) HotPositions(elements [][]byte, topN int) []uint64 {
+	hits := make(map[uint64]int)
+	for _, e := range elements {
+		pos, err := bf.positions(e, bf.hashqty)
+		if err != nil {
+			continue
+		}
+		for _, p := range pos {
+			hits[p]++
+		}
+	}
+
+	hot := make([]uint64, 0, len(hits))
+	for p := range hits {
+		hot = append(hot, p)
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if hits[hot[i]] != hits[hot[j]] {
+			return hits[hot[i]] > hits[hot[j]]
+		}
+		return hot[i] < hot[j]
+	})
+	if topN < len(hot) {
+		hot = hot[:max(topN, 0)]
+	}
+	return hot
+}
+
+// PositionCorrelation measures whether an element's bit positions are independent of each other.
+// It returns the Pearson correlation coefficient between consecutive positions (the i-th and i+1-th hash functions)
+// over all the sample elements. A value near zero means the positions are uncorrelated,
+// whereas a value near 1 or -1 indicates a flawed derivation that inflates the false positive rate beyond theory.
+// Elements that fail to be hashed are skipped.
+func (bf *Filter) PositionCorrelation(elements [][]byte) float64 {
+	positions := make([][]uint64, 0, len(elements))
+	for _, e := range elements {
+		if pos, err := bf.positions(e, bf.hashqty); err == nil {
+			positions = append(positions, pos)
+		}
+	}
+	return positionCorrelation(positions)
+}
+
+// positionCorrelation returns the Pearson correlation coefficient between consecutive positions.
+// It returns zero when there are not enough positions or they don't vary.
+func positionCorrelation(positions [][]uint64) float64 {
+	var n, sumX, sumY, sumXX, sumYY, sumXY float64
+	for _, pos := range positions {
+		for i := 1; i < len(pos); i++ {
+			x, y := float64(pos[i-1]), float64(pos[i])
+			n++
+			sumX += x
+			sumY += y
+			sumXX += x * x
+			sumYY += y * y
+			sumXY += x * y
+		}
+	}
+	if n < 2 {
+		return 0
+	}
+
+	cov := sumXY - sumX*sumY/n
+	varX := sumXX - sumX*sumX/n
+	varY := sumYY - sumY*sumY/n
+	if varX <= 0 || varY <= 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
@@ -0,0 +1,211 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFilter_AdversarialFillRatio(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bf.AdversarialFillRatio(0); got != 0 {
+		t.Errorf("AdversarialFillRatio(0) = %f, want 0", got)
+	}
+	if got := bf.AdversarialFillRatio(5000); got != 1 {
+		t.Errorf("AdversarialFillRatio(5000) = %f, want 1", got)
+	}
+	if bf.SetBits() != 0 {
+		t.Error("AdversarialFillRatio() modified the filter")
+	}
+}
+
+func TestFilter_IsSingleBucket(t *testing.T) {
+	tt := []struct {
+		bf      *Filter
+		element string
+		want    bool
+	}{
+		// bit positions: 38, 47, 35, 34
+		{&Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}, "test", true},
+		{&Filter{hashqty: 7, bitlen: 9585059, bitstore: make([]uint64, 149767)}, "test", false},
+	}
+
+	for _, tc := range tt {
+		got, err := tc.bf.IsSingleBucket([]byte(tc.element))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("IsSingleBucket(%q) with bitlen=%d is %t, want %t", tc.element, tc.bf.bitlen, got, tc.want)
+		}
+	}
+}
+
+func TestFilter_TestVectors(t *testing.T) {
+	tests := map[string]struct {
+		bf   *Filter
+		want TestVector
+	}{
+		"per index": {
+			bf:   &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)},
+			want: TestVector{BitLen: 48, HashQty: 4, Positions: []uint64{38, 47, 35, 34}},
+		},
+		"double": {
+			bf:   &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1), derivation: deriveDouble},
+			want: TestVector{BitLen: 48, HashQty: 4, Derivation: 1, Positions: []uint64{29, 10, 39, 20}},
+		},
+		"modulo": {
+			bf:   &Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1), reduceModulo: true},
+			want: TestVector{BitLen: 48, HashQty: 4, ReduceModulo: true, Positions: []uint64{7, 36, 32, 37}},
+		},
+	}
+
+	elements := [][]byte{[]byte("test"), []byte("test1"), nil}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tc.bf.TestVectors(elements)
+			if len(got) != len(elements) {
+				t.Fatalf("TestVectors() returned %d vectors, want %d", len(got), len(elements))
+			}
+			v, want := got[0], tc.want
+			if string(v.Element) != "test" || v.BitLen != want.BitLen || v.HashQty != want.HashQty || v.Derivation != want.Derivation || v.ReduceModulo != want.ReduceModulo || !equal(v.Positions, want.Positions) {
+				t.Errorf("TestVectors() = %+v, want %+v", v, want)
+			}
+
+			again := tc.bf.TestVectors(elements)
+			for i := range got {
+				if !equal(got[i].Positions, again[i].Positions) {
+					t.Errorf("TestVectors() %q positions = %v, then %v", elements[i], got[i].Positions, again[i].Positions)
+				}
+			}
+		})
+	}
+}
+
+func TestFilter_SampleSetBits(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	setbits := bf.SetBits()
+
+	tt := []struct {
+		fraction float64
+		want     float64
+	}{
+		{0, 0},
+		{0.1, 0.1 * float64(setbits)},
+		{0.5, 0.5 * float64(setbits)},
+		{1, float64(setbits)},
+	}
+
+	for _, tc := range tt {
+		sample := bf.SampleSetBits(tc.fraction)
+		if got := float64(len(sample)); math.Abs(got-tc.want) > tc.want*0.1 {
+			t.Errorf("SampleSetBits(%f) returned %d positions, want about %.0f", tc.fraction, len(sample), tc.want)
+		}
+		if again := bf.SampleSetBits(tc.fraction); !equal(sample, again) {
+			t.Errorf("SampleSetBits(%f) = %v, then %v", tc.fraction, sample, again)
+		}
+		for _, p := range sample {
+			index, offset := bitlocation(p, 64)
+			if bf.bitstore[index]&(1<<offset) == 0 {
+				t.Errorf("SampleSetBits(%f) returned unset position %d", tc.fraction, p)
+			}
+		}
+	}
+}
+
+func TestFilter_CacheLinesTouched(t *testing.T) {
+	tt := []struct {
+		bf      *Filter
+		element string
+		want    int
+	}{
+		{&Filter{hashqty: 4, bitlen: 48, bitstore: make([]uint64, 1)}, "test", 1},
+		{&Filter{hashqty: 7, bitlen: 9585059, bitstore: make([]uint64, 149767)}, "test", 7},
+	}
+
+	for _, tc := range tt {
+		got, err := tc.bf.CacheLinesTouched([]byte(tc.element))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("CacheLinesTouched(%q) with bitlen=%d = %d, want %d", tc.element, tc.bf.bitlen, got, tc.want)
+		}
+	}
+}
+
+func TestFilter_HotPositions(t *testing.T) {
+	bf := &Filter{hashqty: 4, bitlen: 4096, bitstore: make([]uint64, 64)}
+	const hot = 7
+
+	// Craft elements which all hit the hot position.
+	var elements [][]byte
+	for i := 0; len(elements) < 10; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		pos, err := bf.positions(element, bf.hashqty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pos {
+			if p == hot {
+				elements = append(elements, element)
+				break
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		elements = append(elements, []byte(fmt.Sprintf("random%d", i)))
+	}
+
+	got := bf.HotPositions(elements, 3)
+	if len(got) != 3 || got[0] != hot {
+		t.Errorf("HotPositions(3) = %v, want %d first", got, hot)
+	}
+	if got = bf.HotPositions(elements, 0); len(got) != 0 {
+		t.Errorf("HotPositions(0) = %v, want none", got)
+	}
+	if got = bf.HotPositions(nil, 3); len(got) != 0 {
+		t.Errorf("HotPositions(nil, 3) = %v, want none", got)
+	}
+}
+
+func TestFilter_PositionCorrelation(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = []byte(fmt.Sprintf("element%d", i))
+	}
+	if got := bf.PositionCorrelation(elements); math.Abs(got) > 0.1 {
+		t.Errorf("PositionCorrelation() = %f, want near 0", got)
+	}
+	if got := bf.PositionCorrelation(nil); got != 0 {
+		t.Errorf("PositionCorrelation(nil) = %f, want 0", got)
+	}
+
+	// A bad derivation places the next position right after the previous one.
+	positions, err := bf.PrecomputePositions(elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pos := range positions {
+		for i := 1; i < len(pos); i++ {
+			pos[i] = (pos[0] + uint64(i)) % bf.bitlen
+		}
+	}
+	if got := positionCorrelation(positions); got < 0.9 {
+		t.Errorf("positionCorrelation() of bad derivation = %f, want near 1", got)
+	}
+}
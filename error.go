@@ -7,6 +7,40 @@ const (
 	// ErrProbability is returned from New when given probability of false-positives
 	// is not a positive number. Zero probability doesn't make sense.
 	ErrProbability = Error("probability must be positive")
+	// ErrProbabilityRange is returned from New when given probability of false-positives is 1 or greater,
+	// since such a filter would report every element as present.
+	ErrProbabilityRange = Error("probability must be less than 1")
+	// ErrTooManyElements is returned from New when the bit array for given number of elements
+	// can't be allocated.
+	ErrTooManyElements = Error("too many elements")
+	// ErrIncompatible is returned when filters are combined,
+	// but they were created with different parameters (bitlen, hashqty, n, position derivation).
+	ErrIncompatible = Error("filters are incompatible")
+	// ErrRecordWidth is returned from AddFixedWidth when record width is not a positive number.
+	ErrRecordWidth = Error("record width must be positive")
+	// ErrFoldFactor is returned from Fold when bitlen is not divisible by the fold factor.
+	ErrFoldFactor = Error("bitlen must be divisible by fold factor")
+	// ErrShards is returned from ShardOf when number of shards is not a positive number.
+	ErrShards = Error("number of shards must be positive")
+	// ErrNoFilters is returned when filters are combined, but none were given.
+	ErrNoFilters = Error("no filters to combine")
+	// ErrBitstoreExcess is returned from RepairBitstore when the bitstore is longer than bitlen requires,
+	// and truncating it would lose set bits.
+	ErrBitstoreExcess = Error("bitstore has set bits beyond bitlen")
+	// ErrPackedPositions is returned from ApplyPackedPositions when packed positions are malformed
+	// or don't fit into the bit array.
+	ErrPackedPositions = Error("malformed packed positions")
+	// ErrEncoding is returned when a filter can't be decoded from malformed data.
+	ErrEncoding = Error("malformed filter encoding")
+	// ErrSnapshotLength is returned from NewBitsSince when the snapshot length doesn't match the bitstore.
+	ErrSnapshotLength = Error("snapshot length doesn't match bitstore")
+	// ErrStages is returned from NewCascade when number of stages is out of [1, 255] range.
+	ErrStages = Error("number of stages must be from 1 to 255")
+	// ErrSymbol is returned from WriteCHeader when the symbol is not a valid C identifier.
+	ErrSymbol = Error("symbol must be a valid C identifier")
+	// ErrHashSize is returned when a hash function set WithHasher produces sums shorter than 8 bytes
+	// (16 bytes WithDoubleHashing).
+	ErrHashSize = Error("hash sum is too short")
 )
 
 // Error defines Bloom filter errors.
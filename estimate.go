@@ -0,0 +1,193 @@
+package bloom
+
+import (
+	"math"
+	"math/bits"
+	"unsafe"
+)
+
+// SetBits returns the number of set bits in the bitstore.
+// Bits of the last bucket beyond bitlen are not counted.
+func (bf *Filter) SetBits() uint64 {
+	var c uint64
+	for i, b := range bf.bitstore {
+		c += uint64(bits.OnesCount64(b & bf.bucketMask(i)))
+	}
+	return c
+}
+
+// bucketMask returns the mask of the bits of the i-th bucket which are within bitlen,
+// i.e., all the bits except the trailing ones of the last bucket.
+func (bf *Filter) bucketMask(i int) uint64 {
+	if index, offset := bitlocation(bf.bitlen, 64); i == index && offset != 0 {
+		return 1<<offset - 1
+	}
+	return math.MaxUint64
+}
+
+// IsEmpty reports whether no bits are set, i.e., nothing was added to the filter.
+// Unlike SetBits, it stops at the first nonzero bucket, so it's fast for non-empty filters.
+// Bits of the last bucket beyond bitlen are not taken into account.
+func (bf *Filter) IsEmpty() bool {
+	for i, b := range bf.bitstore {
+		if b&bf.bucketMask(i) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// EstimateCount approximates how many distinct elements were added to the filter
+// based on the number of set bits X: -(m/k) * ln(1 - X/m), where m is bitlen, and k is hashqty.
+// When all the bits are set, the estimate is capped as if a single bit was still zero.
+func (bf *Filter) EstimateCount() uint64 {
+	return approxCount(bf.SetBits(), bf.hashqty, bf.bitlen)
+}
+
+// CurrentFalsePositiveRate returns the probability of false positives given how full the filter is: (X/m)^k,
+// where X is the number of set bits, m is bitlen, and k is hashqty.
+// Unlike the prob passed to New which is the designed rate at capacity,
+// it reflects the current fill, e.g., to alert when it exceeds the designed rate.
+func (bf *Filter) CurrentFalsePositiveRate() float64 {
+	return math.Pow(float64(bf.SetBits())/float64(bf.bitlen), float64(bf.hashqty))
+}
+
+// ApproxCountLowerBound returns a conservative estimate of the number of distinct elements in the filter:
+// it is below the true count with the given confidence, e.g., 0.95.
+//
+// The point estimate is -m/k * ln(1 - X/m) where X is the number of set bits.
+// X is modeled as the number of occupied bins after kn balls were thrown into m bins,
+// which is approximately normal with variance m*e^(-kn/m) * (1 - (1 + kn/m)*e^(-kn/m)).
+// The delta method transfers the variance to the estimate, and the bound is
+// the estimate minus z standard deviations, where z is the standard normal quantile of confidence.
+// Confidence below 0.5 gives the point estimate, and confidence of 1 or higher gives zero.
+func (bf *Filter) ApproxCountLowerBound(confidence float64) uint64 {
+	if confidence >= 1 {
+		return 0
+	}
+	if confidence < 0.5 {
+		confidence = 0.5
+	}
+
+	m := float64(bf.bitlen)
+	k := float64(bf.hashqty)
+	x := float64(bf.SetBits())
+	if x >= m {
+		x = m - 1
+	}
+	n := -m / k * math.Log(1-x/m)
+
+	empty := math.Exp(-k * n / m)
+	varX := m * empty * (1 - (1+k*n/m)*empty)
+	sd := math.Sqrt(math.Max(varX, 0)) * m / (k * (m - x))
+
+	z := math.Sqrt2 * math.Erfinv(2*confidence-1)
+	lower := n - z*sd
+	if lower <= 0 {
+		return 0
+	}
+	return uint64(math.Floor(lower))
+}
+
+// FillRatio returns the fraction of set bits relative to bitlen.
+// The last bucket of the bitstore can be larger than needed for bitlen, its trailing bits are not taken into account.
+func (bf *Filter) FillRatio() float64 {
+	return float64(bf.SetBits()) / float64(bf.bitlen)
+}
+
+// BitSetProbability returns the theoretical probability that a given bit is set
+// after the n elements the filter was created for are added: 1 - (1 - 1/bitlen)^(hashqty*n).
+// A large gap between it and FillRatio indicates the filter is under- or overloaded versus its design.
+func (bf *Filter) BitSetProbability() float64 {
+	kn := float64(bf.hashqty) * float64(bf.n)
+	return -math.Expm1(kn * math.Log1p(-1/float64(bf.bitlen)))
+}
+
+// EffectiveHashQty returns hashqty * (1 - fill ratio), a heuristic for how many bits per query
+// still discriminate absent elements. A bit that was already set tells nothing about an absent element,
+// so each hash becomes less useful as the filter saturates: from hashqty on an empty filter down to 0 on a full one.
+func (bf *Filter) EffectiveHashQty() float64 {
+	return float64(bf.hashqty) * (1 - bf.FillRatio())
+}
+
+// OptimalShards returns how many shards n elements should be split into
+// so that each shard's bitstore takes at most targetBytesPerShard bytes, e.g., to fit a cache or a page budget.
+// Each shard is sized for ceil(n/shards) elements with the same probability of false positives.
+// There are no more shards than elements.
+func OptimalShards(n uint64, prob float64, targetBytesPerShard uint64) int {
+	if n == 0 {
+		return 0
+	}
+	shards := uint64(1)
+	if targetBytesPerShard > 0 {
+		total := bitstoreBytes(n, prob)
+		shards = total / targetBytesPerShard
+		if total%targetBytesPerShard != 0 {
+			shards++
+		}
+		shards = min(shards, n)
+	}
+	// Rounding of a shard's capacity and its bitstore can overshoot the target.
+	for shards < n && (targetBytesPerShard == 0 || bitstoreBytes(shardCapacity(n, shards), prob) > targetBytesPerShard) {
+		shards++
+	}
+	return int(shards)
+}
+
+// FPRImprovement returns how much lower the theoretical false positive rate of a filter for n elements
+// with prob probability of false positives would be if it had extraBits more bits than New allocates.
+// The larger filter is assumed to use the optimal number of hash functions for its size.
+// It helps to decide whether spending more memory is worth it.
+func FPRImprovement(n uint64, prob float64, extraBits uint64) float64 {
+	if n == 0 || prob <= 0 {
+		return 0
+	}
+	bitlen := optimalBitLen(n, prob)
+	current := theoreticalFPR(float64(n), optimalHashQty(prob), bitlen)
+
+	bitlen += extraBits
+	k := math.Round(float64(bitlen) / float64(n) * math.Log(2))
+	k = math.Min(math.Max(k, 1), math.MaxUint8)
+	return current - theoreticalFPR(float64(n), byte(k), bitlen)
+}
+
+// shardCapacity returns how many of n elements each of the shards holds.
+func shardCapacity(n uint64, shards uint64) uint64 {
+	c := n / shards
+	if n%shards != 0 {
+		c++
+	}
+	return c
+}
+
+// bitstoreBytes returns the size of the bitstore of a filter for n elements with prob probability of false positives.
+func bitstoreBytes(n uint64, prob float64) uint64 {
+	return bucketqty(optimalBitLen(n, prob)) * 8
+}
+
+// MemoryUsage returns how many bytes the filter occupies: its bitstore and the Filter struct itself.
+func (bf *Filter) MemoryUsage() uint64 {
+	return uint64(len(bf.bitstore))*8 + uint64(unsafe.Sizeof(*bf))
+}
+
+// EstimateMemoryUsage predicts how many bytes a filter for n elements with prob probability of false positives
+// would occupy without allocating it, e.g., to reject a configuration that exceeds a memory budget before calling New.
+func EstimateMemoryUsage(n uint64, prob float64) uint64 {
+	return bitstoreBytes(n, prob) + uint64(unsafe.Sizeof(Filter{}))
+}
+
+// CommonCount estimates how many elements the filters have in common as |A| + |B| - |A ∪ B|,
+// where each set size is estimated from the number of set bits in the respective bitstore
+// (the union bitstore is a bitwise OR of the two).
+// Note, it's an approximation, and its absolute error is of the same order as the error of the union size estimate.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+func (bf *Filter) CommonCount(other *Filter) (uint64, error) {
+	counts, union, err := UnionContributions(bf, other)
+	if err != nil {
+		return 0, err
+	}
+	if counts[0]+counts[1] <= union {
+		return 0, nil
+	}
+	return counts[0] + counts[1] - union, nil
+}
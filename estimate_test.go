@@ -0,0 +1,348 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"unsafe"
+)
+
+func TestFilter_EstimateCount(t *testing.T) {
+	const n = 5000
+	bf, err := New(n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.EstimateCount(); got != 0 {
+		t.Errorf("EstimateCount() of empty filter = %d, want 0", got)
+	}
+	for i := 0; i < n; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		// Repeated elements don't change the estimate.
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	if got := bf.EstimateCount(); math.Abs(float64(got)-n) > n*0.03 {
+		t.Errorf("EstimateCount() = %d, want about %d", got, n)
+	}
+
+	for i := range bf.bitstore {
+		bf.bitstore[i] = math.MaxUint64
+	}
+	bf.bitstore[len(bf.bitstore)-1] >>= uint64(len(bf.bitstore))*64 - bf.bitlen
+	// -m/k * ln(1/m) = -47926/7 * ln(1/47926)
+	if got := bf.EstimateCount(); got != 73788 {
+		t.Errorf("EstimateCount() of saturated filter = %d, want 73788", got)
+	}
+}
+
+func TestFilter_CurrentFalsePositiveRate(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.CurrentFalsePositiveRate(); got != 0 {
+		t.Errorf("CurrentFalsePositiveRate() of empty filter = %f, want 0", got)
+	}
+
+	var prev float64
+	for batch := 0; batch < 10; batch++ {
+		for i := 0; i < 100; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("batch%d element%d", batch, i)))
+		}
+		got := bf.CurrentFalsePositiveRate()
+		if got <= prev {
+			t.Errorf("CurrentFalsePositiveRate() after %d elements = %f, want more than %f", (batch+1)*100, got, prev)
+		}
+		prev = got
+	}
+	// The filter is at its capacity.
+	if math.Abs(prev-bf.prob) > bf.prob*0.2 {
+		t.Errorf("CurrentFalsePositiveRate() at capacity = %f, want about %f", prev, bf.prob)
+	}
+}
+
+func TestFilter_ApproxCountLowerBound(t *testing.T) {
+	const trials = 20
+	const n = 5000
+	var below int
+	for trial := 0; trial < trials; trial++ {
+		bf, err := New(10000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("trial%d element%d", trial, i)))
+		}
+
+		estimate := bf.EstimateCount()
+		lower := bf.ApproxCountLowerBound(0.95)
+		if lower >= estimate {
+			t.Errorf("ApproxCountLowerBound(0.95) = %d, want below estimate %d", lower, estimate)
+		}
+		if lower < n {
+			below++
+		}
+
+		if got := bf.ApproxCountLowerBound(0.5); got > estimate {
+			t.Errorf("ApproxCountLowerBound(0.5) = %d, want estimate %d", got, estimate)
+		}
+		if got := bf.ApproxCountLowerBound(1); got != 0 {
+			t.Errorf("ApproxCountLowerBound(1) = %d, want 0", got)
+		}
+	}
+	if below < trials*17/20 {
+		t.Errorf("ApproxCountLowerBound(0.95) was below the true count in %d of %d trials", below, trials)
+	}
+}
+
+func TestFilter_EffectiveHashQty(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.EffectiveHashQty(); got != float64(bf.hashqty) {
+		t.Errorf("EffectiveHashQty() of empty filter = %f, want %d", got, bf.hashqty)
+	}
+
+	prev := float64(bf.hashqty)
+	for batch := 0; batch < 5; batch++ {
+		for i := 0; i < 500; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("batch%d element%d", batch, i)))
+		}
+		got := bf.EffectiveHashQty()
+		if got >= prev || got <= 0 {
+			t.Errorf("EffectiveHashQty() after batch %d = %f, want in (0, %f)", batch, got, prev)
+		}
+		prev = got
+	}
+
+	for i := range bf.bitstore {
+		bf.bitstore[i] = math.MaxUint64
+	}
+	bf.bitstore[len(bf.bitstore)-1] >>= uint64(len(bf.bitstore))*64 - bf.bitlen
+	if got := bf.EffectiveHashQty(); got != 0 {
+		t.Errorf("EffectiveHashQty() of full filter = %f, want 0", got)
+	}
+}
+
+func TestOptimalShards(t *testing.T) {
+	tt := []struct {
+		n      uint64
+		prob   float64
+		target uint64
+		want   int
+	}{
+		{1000000, 0.01, 64 * 1024, 19},
+		{1000000, 0.01, 1 << 30, 1},
+		{1000000, 0.01, 4096, 293},
+		{100, 0.01, 8, 17},
+		{100, 0.01, 0, 100},
+		{1000, 0.01, 0, 1000},
+		{1000, 0.01, 1, 1000},
+		{1000, 0.01, 2, 1000},
+		{1, 0.01, 1, 1},
+		{0, 0.01, 4096, 0},
+	}
+
+	for _, tc := range tt {
+		got := OptimalShards(tc.n, tc.prob, tc.target)
+		if got != tc.want {
+			t.Errorf("OptimalShards(%d, %f, %d) = %d, want %d", tc.n, tc.prob, tc.target, got, tc.want)
+		}
+		if got == 0 {
+			continue
+		}
+
+		c := shardCapacity(tc.n, uint64(got))
+		if c*uint64(got) < tc.n {
+			t.Errorf("OptimalShards(%d, %f, %d) = %d shards of %d elements, want to cover %d", tc.n, tc.prob, tc.target, got, c, tc.n)
+		}
+		if size := bitstoreBytes(c, tc.prob); tc.target >= 4096 && (size > tc.target || size < tc.target*9/10 && got > 1) {
+			t.Errorf("OptimalShards(%d, %f, %d) shard size = %d bytes, want near %d", tc.n, tc.prob, tc.target, size, tc.target)
+		}
+	}
+}
+
+func TestFilter_CommonCount(t *testing.T) {
+	tt := []struct {
+		name     string
+		from, to int
+		want     float64
+	}{
+		{"overlap", 400, 1000, 200},
+		{"same", 0, 600, 600},
+		{"disjoint", 600, 1000, 0},
+	}
+
+	for _, tc := range tt {
+		a, err := New(1000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(1000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 600; i++ {
+			a.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		}
+		for i := tc.from; i < tc.to; i++ {
+			b.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		}
+
+		got, err := a.CommonCount(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(got)-tc.want) > 50 {
+			t.Errorf("CommonCount(%s) = %d, want about %.0f", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFilter_FillRatio(t *testing.T) {
+	bf, err := New(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bf.FillRatio(); got != 0 {
+		t.Errorf("FillRatio() of empty filter = %f, want 0", got)
+	}
+
+	bf.MustAdd([]byte("test"))
+	if got, want := bf.FillRatio(), float64(bf.hashqty)/float64(bf.bitlen); got > want || got < want*0.7 {
+		t.Errorf("FillRatio() after one Add = %f, want about %f", got, want)
+	}
+
+	// Bits beyond bitlen in the last bucket are not counted.
+	bf = &Filter{hashqty: 4, bitlen: 48, bitstore: []uint64{math.MaxUint64}}
+	if got := bf.FillRatio(); got != 1 {
+		t.Errorf("FillRatio() with trailing bits = %f, want 1", got)
+	}
+}
+
+func TestFilter_BitSetProbability(t *testing.T) {
+	bf, err := New(10000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An optimally sized filter is about half full at its capacity (hashqty is rounded up).
+	want := bf.BitSetProbability()
+	if math.Abs(want-0.5) > 0.05 {
+		t.Errorf("BitSetProbability() = %f, want about 0.5", want)
+	}
+	if got := bf.FillRatio(); got != 0 {
+		t.Errorf("FillRatio() of empty filter = %f, want 0", got)
+	}
+
+	for i := 0; i < 10000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	if got := bf.FillRatio(); math.Abs(got-want) > 0.01 {
+		t.Errorf("FillRatio() = %f, want about BitSetProbability() %f", got, want)
+	}
+}
+
+func TestFilter_SetBits(t *testing.T) {
+	tt := []struct {
+		bitlen   uint64
+		bitstore []uint64
+		want     uint64
+	}{
+		{48, []uint64{0}, 0},
+		// "test" bit positions: 38, 47, 35, 34.
+		{48, []uint64{141063905869824}, 4},
+		// Bits beyond bitlen are masked off.
+		{48, []uint64{math.MaxUint64}, 48},
+		{64, []uint64{math.MaxUint64}, 64},
+		{68, []uint64{math.MaxUint64, 0xff}, 68},
+	}
+
+	for _, tc := range tt {
+		bf := &Filter{hashqty: 4, bitlen: tc.bitlen, bitstore: tc.bitstore}
+		if got := bf.SetBits(); got != tc.want {
+			t.Errorf("SetBits() with bitlen=%d bitstore=%x = %d, want %d", tc.bitlen, tc.bitstore, got, tc.want)
+		}
+	}
+}
+
+func TestFPRImprovement(t *testing.T) {
+	if got := FPRImprovement(1000, 0.01, 0); math.Abs(got) > 0.001 {
+		t.Errorf("FPRImprovement(1000, 0.01, 0) = %f, want about 0", got)
+	}
+
+	prev := FPRImprovement(1000, 0.01, 0)
+	for _, extra := range []uint64{1000, 5000, 10000, 100000} {
+		got := FPRImprovement(1000, 0.01, extra)
+		if got <= prev {
+			t.Errorf("FPRImprovement(1000, 0.01, %d) = %f, want more than %f", extra, got, prev)
+		}
+		// The improvement can't exceed the false positive rate of the filter New allocates.
+		if want := theoreticalFPR(1000, 7, 9586); got > want {
+			t.Errorf("FPRImprovement(1000, 0.01, %d) = %f, want at most %f", extra, got, want)
+		}
+		prev = got
+	}
+
+	if got := FPRImprovement(0, 0.01, 1000); got != 0 {
+		t.Errorf("FPRImprovement(0, 0.01, 1000) = %f, want 0", got)
+	}
+}
+
+func TestFilter_MemoryUsage(t *testing.T) {
+	bf, err := New(1000000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overhead := uint64(unsafe.Sizeof(Filter{}))
+	// 9585059 bits are stored in 149767 buckets.
+	if got, want := bf.MemoryUsage(), 149767*8+overhead; got != want {
+		t.Errorf("MemoryUsage() = %d, want %d", got, want)
+	}
+	if got, want := EstimateMemoryUsage(1000000, 0.01), bf.MemoryUsage(); got != want {
+		t.Errorf("EstimateMemoryUsage(1000000, 0.01) = %d, want %d", got, want)
+	}
+}
+
+func TestEstimateMemoryUsage(t *testing.T) {
+	overhead := uint64(unsafe.Sizeof(Filter{}))
+	tt := []struct {
+		n    uint64
+		prob float64
+		want uint64
+	}{
+		{1000000, 0.01, 1198136 + overhead},       // 1.198 MB
+		{2147483647, 0.01, 2572969520 + overhead}, // 2.573 GB
+		{4294967295, 0.01, 5145939032 + overhead}, // 5.146 GB
+	}
+
+	for _, tc := range tt {
+		if got := EstimateMemoryUsage(tc.n, tc.prob); got != tc.want {
+			t.Errorf("EstimateMemoryUsage(%d, %f) = %d, want %d", tc.n, tc.prob, got, tc.want)
+		}
+	}
+}
+
+func TestFilter_IsEmpty(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bf.IsEmpty() {
+		t.Errorf("IsEmpty() of fresh filter is false, want true")
+	}
+	bf.MustAdd([]byte("test"))
+	if bf.IsEmpty() {
+		t.Errorf("IsEmpty() after Add is true, want false")
+	}
+
+	// Bits beyond bitlen in the last bucket are not taken into account.
+	bf = &Filter{hashqty: 4, bitlen: 48, bitstore: []uint64{1 << 50}}
+	if !bf.IsEmpty() {
+		t.Errorf("IsEmpty() with trailing bits is false, want true")
+	}
+	bf.bitstore[0] |= 1 << 47
+	if bf.IsEmpty() {
+		t.Errorf("IsEmpty() with bit 47 set is true, want false")
+	}
+}
@@ -70,3 +70,43 @@ func ExampleNew_error() {
 	// number of elements must be positive
 	// probability must be positive
 }
+
+// AddString and HasString work with string elements without converting them to bytes,
+// and they produce the same bit positions as Add and Has.
+func ExampleFilter_AddString() {
+	bf, err := bloom.New(100, 0.01)
+	if err != nil {
+		log.Fatalf("Bloom filter is not created: %v", err)
+	}
+
+	if err = bf.AddString("bob@example.com"); err != nil {
+		log.Fatalf("Bloom filter couldn't add element: %v", err)
+	}
+
+	isIn, err := bf.Has([]byte("bob@example.com"))
+	if err != nil {
+		log.Fatalf("Bloom filter couldn't test element: %v", err)
+	}
+	fmt.Println(isIn)
+	// Output:
+	// true
+}
+
+func ExampleFilter_HasString() {
+	bf, err := bloom.New(100, 0.01)
+	if err != nil {
+		log.Fatalf("Bloom filter is not created: %v", err)
+	}
+	bf.MustAdd([]byte("alice@example.com"))
+
+	for _, email := range []string{"alice@example.com", "eve@example.com"} {
+		isIn, err := bf.HasString(email)
+		if err != nil {
+			log.Fatalf("Bloom filter couldn't test element: %v", err)
+		}
+		fmt.Println(email, isIn)
+	}
+	// Output:
+	// alice@example.com true
+	// eve@example.com false
+}
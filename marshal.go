@@ -0,0 +1,321 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// encodingVersion is the version of the binary encoding of a filter.
+// Version 3 changed the reduction of hashes to bit positions from modulo bitlen to Lemire's reduction,
+// version 4 added the position derivation, and version 5 the reduction,
+// so filters migrated from the versions before 3 keep their modulo positions when they're encoded again.
+const encodingVersion = 5
+
+// headerSize is the size of the encoded filter header:
+// version (1 byte), prob (8), bitlen (8), hashqty (1), n (8), count (8), position derivation (1), modulo reduction (1).
+const headerSize = 36
+
+const (
+	// headerSizeV1 is the size of the header of the version 1 encoding which stored n in 4 bytes.
+	headerSizeV1 = 30
+	// headerSizeV3 is the size of the header of the versions 2 and 3 encoding which didn't store the position derivation.
+	headerSizeV3 = 34
+	// headerSizeV4 is the size of the header of the version 4 encoding which didn't store the reduction.
+	headerSizeV4 = 35
+)
+
+// MarshalBinary encodes the filter into a binary form.
+// All numbers are stored in little-endian byte order: the header with the filter parameters
+// followed by the bitstore buckets.
+// The position derivation (e.g., WithDoubleHashing) is encoded, but the hash function isn't,
+// a decoding filter keeps its own (SHA-256 by default).
+func (bf *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, headerSize, headerSize+len(bf.bitstore)*8)
+	bf.putHeader(data)
+	for _, b := range bf.bitstore {
+		data = binary.LittleEndian.AppendUint64(data, b)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the filter from data produced by MarshalBinary.
+// It returns an error wrapping ErrEncoding if data is malformed,
+// e.g., the number of buckets doesn't match the encoded bitlen.
+func (bf *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return fmt.Errorf("%w: header is %d bytes, want %d", ErrEncoding, len(data), headerSize)
+	}
+	var f Filter
+	if err := f.parseHeader(data[:headerSize]); err != nil {
+		return err
+	}
+
+	data = data[headerSize:]
+	buckets := bucketqty(f.bitlen)
+	if uint64(len(data))%8 != 0 || uint64(len(data))/8 != buckets {
+		return fmt.Errorf("%w: bitlen %d needs %d buckets, got %d bytes", ErrEncoding, f.bitlen, buckets, len(data))
+	}
+	f.bitstore = make([]uint64, buckets)
+	for i := range f.bitstore {
+		f.bitstore[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+
+	f.hasher = bf.hasher
+	*bf = f
+	return nil
+}
+
+// WriteTo writes the filter to w in the same binary form as MarshalBinary.
+// The bitstore is streamed in chunks, so unlike MarshalBinary it doesn't hold a copy of the whole filter in memory.
+// It returns the number of bytes written.
+func (bf *Filter) WriteTo(w io.Writer) (int64, error) {
+	return bf.WriteToProgress(w, nil)
+}
+
+// WriteToProgress is similar to WriteTo, but it calls onProgress after each written chunk,
+// e.g., to show a progress bar while a large filter is exported.
+// The callback receives the number of bytes written so far and the total size of the encoded filter.
+func (bf *Filter) WriteToProgress(w io.Writer, onProgress func(written, total int64)) (int64, error) {
+	total := int64(headerSize + len(bf.bitstore)*8)
+	buf := make([]byte, chunkSize)
+	bf.putHeader(buf)
+	n, err := w.Write(buf[:headerSize])
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	if onProgress != nil {
+		onProgress(written, total)
+	}
+
+	for start := 0; start < len(bf.bitstore); start += chunkSize / 8 {
+		end := start + chunkSize/8
+		if end > len(bf.bitstore) {
+			end = len(bf.bitstore)
+		}
+		chunk := buf[:0]
+		for _, b := range bf.bitstore[start:end] {
+			chunk = binary.LittleEndian.AppendUint64(chunk, b)
+		}
+
+		n, err = w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if onProgress != nil {
+			onProgress(written, total)
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom reads the filter from r written by WriteTo or MarshalBinary.
+// It reads exactly as many bytes as the header declares and returns their number.
+// An error wrapping ErrEncoding is returned if the stream is malformed or truncated.
+func (bf *Filter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, chunkSize)
+	n, err := io.ReadFull(r, buf[:headerSize])
+	read := int64(n)
+	if err != nil {
+		return read, truncated(err, "header")
+	}
+	var f Filter
+	if err = f.parseHeader(buf[:headerSize]); err != nil {
+		return read, err
+	}
+
+	m, err := f.readBitstore(r, buf)
+	read += m
+	if err != nil {
+		return read, err
+	}
+	f.hasher = bf.hasher
+	*bf = f
+	return read, nil
+}
+
+// readBitstore reads the bitstore buckets for bitlen bits from r in chunks of buf size.
+// The bitstore grows as the chunks arrive, so a truncated stream can't force a large allocation.
+// It returns the number of bytes read.
+func (bf *Filter) readBitstore(r io.Reader, buf []byte) (int64, error) {
+	var read int64
+	remaining := bucketqty(bf.bitlen)
+	bf.bitstore = make([]uint64, 0, min(remaining, uint64(len(buf)/8)))
+	for remaining > 0 {
+		chunk := buf[:min(remaining, uint64(len(buf)/8))*8]
+		n, err := io.ReadFull(r, chunk)
+		read += int64(n)
+		if err != nil {
+			return read, truncated(err, "bitstore")
+		}
+		for i := 0; i < len(chunk); i += 8 {
+			bf.bitstore = append(bf.bitstore, binary.LittleEndian.Uint64(chunk[i:]))
+		}
+		remaining -= uint64(len(chunk) / 8)
+	}
+	return read, nil
+}
+
+// chunkSize is the size of a buffer to stream the bitstore with, it must be a multiple of 8 and fit the header.
+const chunkSize = 32 * 1024
+
+// truncated converts premature EOF errors into ErrEncoding which names the truncated part of the stream.
+func truncated(err error, part string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s is truncated", ErrEncoding, part)
+	}
+	return err
+}
+
+// putHeader encodes the filter parameters into the first headerSize bytes of b.
+func (bf *Filter) putHeader(b []byte) {
+	b[0] = encodingVersion
+	binary.LittleEndian.PutUint64(b[1:], math.Float64bits(bf.prob))
+	binary.LittleEndian.PutUint64(b[9:], bf.bitlen)
+	b[17] = bf.hashqty
+	binary.LittleEndian.PutUint64(b[18:], bf.n)
+	binary.LittleEndian.PutUint64(b[26:], bf.count)
+	b[34] = byte(bf.derivation)
+	if bf.reduceModulo {
+		b[35] = 1
+	}
+}
+
+// parseHeader decodes the filter parameters from the header b and validates them.
+func (bf *Filter) parseHeader(b []byte) error {
+	if b[0] != encodingVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrEncoding, b[0])
+	}
+	bf.parseParams(b)
+	bf.derivation = derivation(b[34])
+	switch b[35] {
+	case 0:
+	case 1:
+		bf.reduceModulo = true
+	default:
+		return fmt.Errorf("%w: unknown reduction %d", ErrEncoding, b[35])
+	}
+	return bf.validateHeader()
+}
+
+// parseParams decodes the filter parameters which are laid out the same way since the version 2 encoding.
+func (bf *Filter) parseParams(b []byte) {
+	bf.prob = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
+	bf.bitlen = binary.LittleEndian.Uint64(b[9:])
+	bf.hashqty = b[17]
+	bf.n = binary.LittleEndian.Uint64(b[18:])
+	bf.count = binary.LittleEndian.Uint64(b[26:])
+}
+
+// validateHeader checks the decoded filter parameters.
+func (bf *Filter) validateHeader() error {
+	switch {
+	case bf.n == 0:
+		return fmt.Errorf("%w: %v", ErrEncoding, ErrZeroElements)
+	case !(bf.prob > 0):
+		return fmt.Errorf("%w: %v", ErrEncoding, ErrProbability)
+	case bf.prob >= 1:
+		return fmt.Errorf("%w: %v", ErrEncoding, ErrProbabilityRange)
+	case bf.bitlen == 0:
+		return fmt.Errorf("%w: bitlen must be positive", ErrEncoding)
+	case !fits(bf.bitlen):
+		return fmt.Errorf("%w: bitlen %d is too large", ErrEncoding, bf.bitlen)
+	case bf.hashqty == 0:
+		return fmt.Errorf("%w: number of hash functions must be positive", ErrEncoding)
+	case bf.derivation > deriveWide:
+		return fmt.Errorf("%w: unknown position derivation %d", ErrEncoding, bf.derivation)
+	case bf.reduceModulo && bf.derivation != derivePerIndex:
+		return fmt.Errorf("%w: modulo reduction requires a position per hash function index", ErrEncoding)
+	}
+	return nil
+}
+
+// migrations decode older versions of the binary encoding into the current in-memory representation.
+// Each version is upgraded by its own function, e.g., to fill in a field the version didn't store.
+var migrations = map[byte]func(r io.Reader) (*Filter, error){
+	1: migrateV1,
+	2: migrateV2,
+	3: migrateV3,
+	4: migrateV4,
+}
+
+// migrateV1 reads the filter from r in the version 1 encoding which stored n in 4 bytes
+// and reduced hashes to bit positions with modulo bitlen.
+func migrateV1(r io.Reader) (*Filter, error) {
+	return migrate(r, headerSizeV1, func(bf *Filter, b []byte) {
+		bf.prob = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
+		bf.bitlen = binary.LittleEndian.Uint64(b[9:])
+		bf.hashqty = b[17]
+		bf.n = uint64(binary.LittleEndian.Uint32(b[18:]))
+		bf.count = binary.LittleEndian.Uint64(b[22:])
+		bf.reduceModulo = true
+	})
+}
+
+// migrateV2 reads the filter from r in the version 2 encoding which reduced hashes to bit positions with modulo bitlen.
+func migrateV2(r io.Reader) (*Filter, error) {
+	return migrate(r, headerSizeV3, func(bf *Filter, b []byte) {
+		bf.parseParams(b)
+		bf.reduceModulo = true
+	})
+}
+
+// migrateV3 reads the filter from r in the version 3 encoding which didn't store the position derivation,
+// i.e., the filter derives a position per hash function index.
+func migrateV3(r io.Reader) (*Filter, error) {
+	return migrate(r, headerSizeV3, (*Filter).parseParams)
+}
+
+// migrateV4 reads the filter from r in the version 4 encoding which didn't store the reduction,
+// i.e., the filter uses Lemire's reduction.
+func migrateV4(r io.Reader) (*Filter, error) {
+	return migrate(r, headerSizeV4, func(bf *Filter, b []byte) {
+		bf.parseParams(b)
+		bf.derivation = derivation(b[34])
+	})
+}
+
+// migrate reads the filter from r in an older version of the encoding whose header of size bytes is decoded by parse.
+func migrate(r io.Reader, size int, parse func(bf *Filter, header []byte)) (*Filter, error) {
+	buf := make([]byte, chunkSize)
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return nil, truncated(err, "header")
+	}
+	var bf Filter
+	parse(&bf, buf[:size])
+	if err := bf.validateHeader(); err != nil {
+		return nil, err
+	}
+	if _, err := bf.readBitstore(r, buf); err != nil {
+		return nil, err
+	}
+	return &bf, nil
+}
+
+// LoadWithMigration reads the filter from r in the current or any older version of the binary encoding,
+// so callers don't have to handle each historical format.
+// An error wrapping ErrEncoding is returned if the stream is malformed or its version is unknown.
+func LoadWithMigration(r io.Reader) (*Filter, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return nil, truncated(err, "header")
+	}
+	r = io.MultiReader(bytes.NewReader(version[:]), r)
+
+	if version[0] == encodingVersion {
+		var bf Filter
+		if _, err := bf.ReadFrom(r); err != nil {
+			return nil, err
+		}
+		return &bf, nil
+	}
+	migrate, ok := migrations[version[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrEncoding, version[0])
+	}
+	return migrate(r)
+}
@@ -0,0 +1,382 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFilter_MarshalBinary(t *testing.T) {
+	bf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := headerSize + len(bf.bitstore)*8; len(data) != want {
+		t.Errorf("MarshalBinary() len = %d, want %d", len(data), want)
+	}
+
+	var got Filter
+	if err = got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.prob != bf.prob || got.bitlen != bf.bitlen || got.hashqty != bf.hashqty || got.n != bf.n || got.count != bf.count {
+		t.Errorf("UnmarshalBinary() = %+v, want %+v", got, bf)
+	}
+	if !equal(got.bitstore, bf.bitstore) {
+		t.Error("UnmarshalBinary() bitstore differs")
+	}
+	for i := 0; i < 2000; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if got.MustHave(element) != bf.MustHave(element) {
+			t.Errorf("UnmarshalBinary() Has(%q) = %t, want %t", element, got.MustHave(element), bf.MustHave(element))
+		}
+	}
+}
+
+func TestFilter_MarshalBinary_layout(t *testing.T) {
+	bf := &Filter{
+		prob:     0.5,
+		bitlen:   68,
+		hashqty:  4,
+		n:        7,
+		count:    3,
+		bitstore: []uint64{0x0102030405060708, 9},
+		// The derivation is pinned at byte 34.
+		derivation: deriveWide,
+	}
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		5,                            // version
+		0, 0, 0, 0, 0, 0, 0xe0, 0x3f, // prob 0.5
+		68, 0, 0, 0, 0, 0, 0, 0, // bitlen
+		4,                      // hashqty
+		7, 0, 0, 0, 0, 0, 0, 0, // n
+		3, 0, 0, 0, 0, 0, 0, 0, // count
+		2,                      // derivation
+		0,                      // modulo reduction
+		8, 7, 6, 5, 4, 3, 2, 1, // bucket 0
+		9, 0, 0, 0, 0, 0, 0, 0, // bucket 1
+	}
+	if string(data) != string(want) {
+		t.Errorf("MarshalBinary() = %v, want %v", data, want)
+	}
+}
+
+func TestFilter_MarshalBinary_derivation(t *testing.T) {
+	for _, opt := range []Option{WithDoubleHashing(), WithWideHashing()} {
+		bf, err := New(1000, 0.01, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		}
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The decoding filter uses the encoded derivation rather than its own.
+		var got Filter
+		if err = got.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if got.derivation != bf.derivation {
+			t.Errorf("UnmarshalBinary() derivation = %d, want %d", got.derivation, bf.derivation)
+		}
+		for i := 0; i < 1000; i++ {
+			element := []byte(fmt.Sprintf("element%d", i))
+			if !got.MustHave(element) {
+				t.Fatalf("UnmarshalBinary() Has(%q) is false, want true", element)
+			}
+		}
+	}
+}
+
+func TestFilter_UnmarshalBinary_error(t *testing.T) {
+	bf := &Filter{prob: 0.5, bitlen: 68, hashqty: 4, n: 7, bitstore: []uint64{1, 2}}
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(i int, b byte) []byte {
+		d := append([]byte(nil), data...)
+		d[i] = b
+		return d
+	}
+	// Modulo reduction is only defined for a position per hash function index.
+	moduloDouble := corrupt(35, 1)
+	moduloDouble[34] = byte(deriveDouble)
+
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", data[:headerSize-1]},
+		{"missing bucket", data[:len(data)-8]},
+		{"partial bucket", data[:len(data)-1]},
+		{"extra bucket", append(append([]byte(nil), data...), make([]byte, 8)...)},
+		{"version", corrupt(0, 6)},
+		{"old version", corrupt(0, 4)},
+		{"bitlen", corrupt(9, 200)},
+		{"zero hashqty", corrupt(17, 0)},
+		{"zero n", corrupt(18, 0)},
+		{"derivation", corrupt(34, 3)},
+		{"reduction", corrupt(35, 2)},
+		{"modulo derivation", moduloDouble},
+	}
+
+	for _, tc := range tt {
+		var got Filter
+		if err := got.UnmarshalBinary(tc.data); !errors.Is(err, ErrEncoding) {
+			t.Errorf("UnmarshalBinary(%s) error: %v, want %q", tc.name, err, ErrEncoding)
+		}
+	}
+}
+
+func TestFilter_WriteTo(t *testing.T) {
+	// The bitstore spans several chunks.
+	bf, err := New(100000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100000; i++ {
+		bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+	}
+	want, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	written, err := bf.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(want)) || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("WriteTo() wrote %d bytes, want %d bytes same as MarshalBinary", written, len(want))
+	}
+
+	// Trailing data must not be consumed.
+	buf.WriteString("tail")
+	var got Filter
+	read, err := got.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written {
+		t.Errorf("ReadFrom() read %d bytes, want %d", read, written)
+	}
+	if got.prob != bf.prob || got.bitlen != bf.bitlen || got.hashqty != bf.hashqty || got.n != bf.n || !equal(got.bitstore, bf.bitstore) {
+		t.Error("ReadFrom() filter differs from the written one")
+	}
+	if buf.String() != "tail" {
+		t.Errorf("ReadFrom() left %q in the stream, want %q", buf.String(), "tail")
+	}
+}
+
+func TestFilter_ReadFrom_error(t *testing.T) {
+	bf, err := New(100000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, headerSize - 1, headerSize, headerSize + chunkSize + 1, len(data) - 1} {
+		var got Filter
+		read, err := got.ReadFrom(bytes.NewReader(data[:size]))
+		if !errors.Is(err, ErrEncoding) {
+			t.Errorf("ReadFrom(%d bytes) error: %v, want %q", size, err, ErrEncoding)
+		}
+		if read != int64(size) {
+			t.Errorf("ReadFrom(%d bytes) read %d bytes", size, read)
+		}
+	}
+
+	// A hostile header must not make ReadFrom allocate a bitstore before its data arrives.
+	for _, bitlen := range []uint64{math.MaxUint64 - 1, 1 << 43} {
+		header := append([]byte(nil), data[:headerSize]...)
+		binary.LittleEndian.PutUint64(header[9:], bitlen)
+
+		var got Filter
+		read, err := got.ReadFrom(bytes.NewReader(header))
+		if !errors.Is(err, ErrEncoding) {
+			t.Errorf("ReadFrom(bitlen %d) error: %v, want %q", bitlen, err, ErrEncoding)
+		}
+		if read != headerSize {
+			t.Errorf("ReadFrom(bitlen %d) read %d bytes, want %d", bitlen, read, headerSize)
+		}
+	}
+}
+
+func TestFilter_WriteToProgress(t *testing.T) {
+	bf, err := New(100000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []int64
+	var buf bytes.Buffer
+	written, err := bf.WriteToProgress(&buf, func(written, total int64) {
+		if want := int64(buf.Len()); total != int64(headerSize+len(bf.bitstore)*8) || written != want {
+			t.Errorf("onProgress(%d, %d), want %d bytes written", written, total, want)
+		}
+		calls = append(calls, written)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header and 4 chunks of the bitstore.
+	if len(calls) != 5 {
+		t.Errorf("onProgress was called %d times, want 5", len(calls))
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i] <= calls[i-1] {
+			t.Errorf("onProgress written = %v, want monotonically increasing", calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last != written || written != int64(buf.Len()) {
+		t.Errorf("onProgress last written = %d, WriteToProgress() = %d, want %d", last, written, buf.Len())
+	}
+}
+
+func TestLoadWithMigration(t *testing.T) {
+	v1 := []byte{
+		1,                            // version
+		0, 0, 0, 0, 0, 0, 0xe0, 0x3f, // prob 0.5
+		48, 0, 0, 0, 0, 0, 0, 0, // bitlen
+		4,          // hashqty
+		1, 0, 0, 0, // n
+		1, 0, 0, 0, 0, 0, 0, 0, // count
+		0x80, 0, 0, 0, 0x31, 0, 0, 0, // "test" bit positions: 7, 36, 32, 37
+	}
+	bf, err := LoadWithMigration(bytes.NewReader(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.prob != 0.5 || bf.bitlen != 48 || bf.hashqty != 4 || bf.n != 1 || bf.count != 1 {
+		t.Errorf("LoadWithMigration() = %+v", bf)
+	}
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("LoadWithMigration() Has(%q) is false, want true", "test")
+	}
+
+	// The migrated filter keeps the modulo reduction when it's encoded in the current version.
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != encodingVersion || data[35] != 1 {
+		t.Errorf("MarshalBinary() header = %v, want version %d with modulo reduction", data[:headerSize], encodingVersion)
+	}
+	if bf, err = LoadWithMigration(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("LoadWithMigration(MarshalBinary()) Has(%q) is false, want true", "test")
+	}
+}
+
+func TestLoadWithMigration_v2(t *testing.T) {
+	v2 := []byte{
+		2,                            // version
+		0, 0, 0, 0, 0, 0, 0xe0, 0x3f, // prob 0.5
+		48, 0, 0, 0, 0, 0, 0, 0, // bitlen
+		4,                      // hashqty
+		1, 0, 0, 0, 0, 0, 0, 0, // n
+		1, 0, 0, 0, 0, 0, 0, 0, // count
+		0x80, 0, 0, 0, 0x31, 0, 0, 0, // "test" bit positions: 7, 36, 32, 37
+	}
+	bf, err := LoadWithMigration(bytes.NewReader(v2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.prob != 0.5 || bf.bitlen != 48 || bf.hashqty != 4 || bf.n != 1 || bf.count != 1 || !bf.reduceModulo {
+		t.Errorf("LoadWithMigration() = %+v", bf)
+	}
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("LoadWithMigration() Has(%q) is false, want true", "test")
+	}
+}
+
+func TestLoadWithMigration_v3(t *testing.T) {
+	v3 := []byte{
+		3,                            // version
+		0, 0, 0, 0, 0, 0, 0xe0, 0x3f, // prob 0.5
+		48, 0, 0, 0, 0, 0, 0, 0, // bitlen
+		4,                      // hashqty
+		1, 0, 0, 0, 0, 0, 0, 0, // n
+		1, 0, 0, 0, 0, 0, 0, 0, // count
+		0, 0, 0, 0, 0x4c, 0x80, 0, 0, // "test" bit positions: 38, 47, 35, 34
+	}
+	bf, err := LoadWithMigration(bytes.NewReader(v3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.prob != 0.5 || bf.bitlen != 48 || bf.hashqty != 4 || bf.n != 1 || bf.count != 1 || bf.derivation != derivePerIndex {
+		t.Errorf("LoadWithMigration() = %+v", bf)
+	}
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("LoadWithMigration() Has(%q) is false, want true", "test")
+	}
+}
+
+func TestLoadWithMigration_v4(t *testing.T) {
+	v4 := []byte{
+		4,                            // version
+		0, 0, 0, 0, 0, 0, 0xe0, 0x3f, // prob 0.5
+		48, 0, 0, 0, 0, 0, 0, 0, // bitlen
+		4,                      // hashqty
+		1, 0, 0, 0, 0, 0, 0, 0, // n
+		1, 0, 0, 0, 0, 0, 0, 0, // count
+		0,                            // derivation
+		0, 0, 0, 0, 0x4c, 0x80, 0, 0, // "test" bit positions: 38, 47, 35, 34
+	}
+	bf, err := LoadWithMigration(bytes.NewReader(v4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.reduceModulo || bf.derivation != derivePerIndex {
+		t.Errorf("LoadWithMigration() = %+v", bf)
+	}
+	if !bf.MustHave([]byte("test")) {
+		t.Errorf("LoadWithMigration() Has(%q) is false, want true", "test")
+	}
+}
+
+func TestLoadWithMigration_error(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown version", []byte{0, 1, 2}},
+		{"truncated", []byte{encodingVersion, 0, 0}},
+		{"truncated version 1", []byte{1, 0, 0}},
+	}
+
+	for _, tc := range tt {
+		if _, err := LoadWithMigration(bytes.NewReader(tc.data)); !errors.Is(err, ErrEncoding) {
+			t.Errorf("LoadWithMigration(%s) error: %v, want %q", tc.name, err, ErrEncoding)
+		}
+	}
+}
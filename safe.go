@@ -0,0 +1,50 @@
+package bloom
+
+import "sync"
+
+// SafeFilter is a Bloom filter which is safe for concurrent use.
+// Add takes the write lock, and Has takes the read lock, so concurrent lookups don't block each other.
+type SafeFilter struct {
+	sync.RWMutex
+	filter *Filter
+}
+
+// NewSafe creates a new concurrency safe Bloom filter for n elements
+// based on tolerated error rate of false positives, see New.
+func NewSafe(n uint64, prob float64) (*SafeFilter, error) {
+	bf, err := New(n, prob)
+	if err != nil {
+		return nil, err
+	}
+	return &SafeFilter{filter: bf}, nil
+}
+
+// Add adds an element to the set.
+func (sf *SafeFilter) Add(element []byte) error {
+	sf.Lock()
+	defer sf.Unlock()
+	return sf.filter.Add(element)
+}
+
+// Has tests if the element is in the set.
+func (sf *SafeFilter) Has(element []byte) (bool, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	return sf.filter.Has(element)
+}
+
+// MustAdd is similar to Add, but it panics if the error is not nil.
+func (sf *SafeFilter) MustAdd(element []byte) {
+	if err := sf.Add(element); err != nil {
+		panic(err)
+	}
+}
+
+// MustHave is similar to Has, but it panics if the error is not nil.
+func (sf *SafeFilter) MustHave(element []byte) bool {
+	isIn, err := sf.Has(element)
+	if err != nil {
+		panic(err)
+	}
+	return isIn
+}
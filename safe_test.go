@@ -0,0 +1,45 @@
+package bloom
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSafeFilter(t *testing.T) {
+	sf, err := NewSafe(10000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				element := []byte(fmt.Sprintf("goroutine%d element%d", g, i))
+				sf.MustAdd(element)
+				if !sf.MustHave(element) {
+					t.Errorf("Has(%q) is false, want true", element)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 500; i++ {
+			element := []byte(fmt.Sprintf("goroutine%d element%d", g, i))
+			if !sf.MustHave(element) {
+				t.Errorf("Has(%q) is false, want true", element)
+			}
+		}
+	}
+}
+
+func TestNewSafe_error(t *testing.T) {
+	if _, err := NewSafe(0, 0.01); err != ErrZeroElements {
+		t.Errorf("NewSafe(0, 0.01) error: %q, want %q", err, ErrZeroElements)
+	}
+}
@@ -0,0 +1,126 @@
+package bloom
+
+import "math"
+
+const (
+	// scalableGrowth is how many times the capacity of each next filter of ScalableFilter grows.
+	scalableGrowth = 2
+	// scalableTightening is how many times the probability of false positives of each next filter shrinks.
+	// Probabilities form a geometric series prob*(1-r), prob*(1-r)*r, ... which sums up to prob.
+	scalableTightening = 0.5
+	// scalableOverfill limits how often the fill of the active filter is estimated:
+	// at least n/scalableOverfill insertions happen between the estimates,
+	// so the filter can overfill its capacity by that many distinct elements.
+	scalableOverfill = 64
+)
+
+// ScalableFilter is a Bloom filter that grows past its initial capacity.
+// When the newest filter fills up to its capacity, a larger one is appended with a tighter probability of false positives,
+// so the compound probability stays under the desired one.
+// Operations are not concurrency safe.
+type ScalableFilter struct {
+	// prob is a desired compound probability of false positives.
+	prob float64
+	// filters are the added filters, the last one is active, i.e., receives new elements.
+	filters []*Filter
+	// nextCheck is the number of insertions into the active filter when its fill is estimated next.
+	nextCheck uint64
+}
+
+// NewScalable creates a scalable Bloom filter which initially expects initialN elements
+// with the compound prob probability of false positives.
+// It returns the same errors as New for invalid parameters.
+func NewScalable(initialN uint64, prob float64) (*ScalableFilter, error) {
+	if err := checkProb(prob); err != nil {
+		return nil, err
+	}
+	sf := ScalableFilter{prob: prob}
+	if err := sf.grow(initialN); err != nil {
+		return nil, err
+	}
+	return &sf, nil
+}
+
+// grow appends a filter for n elements with a probability of false positives tightened for its position.
+func (sf *ScalableFilter) grow(n uint64) error {
+	bf, err := New(n, sf.sliceProb(len(sf.filters)))
+	if err != nil {
+		return err
+	}
+	sf.filters = append(sf.filters, bf)
+	sf.nextCheck = n
+	return nil
+}
+
+// sliceProb returns the probability of false positives of the i-th filter.
+func (sf *ScalableFilter) sliceProb(i int) float64 {
+	return sf.prob * (1 - scalableTightening) * math.Pow(scalableTightening, float64(i))
+}
+
+// Add adds the element to the newest filter.
+// A larger filter is appended first if the newest filter reached its capacity.
+func (sf *ScalableFilter) Add(element []byte) error {
+	bf := sf.filters[len(sf.filters)-1]
+	// Counting set bits is expensive, so it's done only when the number of insertions (including duplicates)
+	// reaches the capacity, since the estimated count can't be greater than that.
+	// If duplicates kept the estimate below the capacity, it's estimated again after as many insertions
+	// as there is room left for distinct elements, so duplicate-heavy inserts don't count set bits every time.
+	if bf.count >= sf.nextCheck {
+		if estimate := bf.EstimateCount(); estimate < bf.n {
+			step := max(bf.n-estimate, bf.n/scalableOverfill, 1)
+			sf.nextCheck = bf.count + min(step, math.MaxUint64-bf.count)
+			return bf.Add(element)
+		}
+
+		n := bf.n * scalableGrowth
+		if n/scalableGrowth != bf.n {
+			n = math.MaxUint64
+		}
+		if err := sf.grow(n); err != nil {
+			return err
+		}
+		bf = sf.filters[len(sf.filters)-1]
+	}
+	return bf.Add(element)
+}
+
+// Has tests if the element is in the set, i.e., any of the filters reports it.
+func (sf *ScalableFilter) Has(element []byte) (bool, error) {
+	for _, bf := range sf.filters {
+		isIn, err := bf.Has(element)
+		if err != nil || isIn {
+			return isIn, err
+		}
+	}
+	return false, nil
+}
+
+// QueryDepth returns how many filters Has checks at most, i.e., the number of filters.
+// It rises as the filter grows, and query latency with it, so it can be used to trigger a compaction.
+func (sf *ScalableFilter) QueryDepth() int {
+	return len(sf.filters)
+}
+
+// Compact replaces all the filters with a single one sized for the approximate total number of elements,
+// so Has checks one filter again, and returns it.
+// Bloom filters can't be rebuilt from their bits, so the caller must provide all the elements that were added;
+// those which are not provided are lost.
+// The scalable filter is left unmodified on error.
+func (sf *ScalableFilter) Compact(elements [][]byte) (*Filter, error) {
+	var total uint64
+	for _, bf := range sf.filters {
+		total += bf.EstimateCount()
+	}
+	total = max(total, uint64(len(elements)), 1)
+
+	bf, err := New(total, sf.sliceProb(0))
+	if err != nil {
+		return nil, err
+	}
+	if err = bf.AddAll(elements); err != nil {
+		return nil, err
+	}
+	sf.filters = []*Filter{bf}
+	sf.nextCheck = bf.n
+	return bf, nil
+}
@@ -0,0 +1,169 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScalableFilter(t *testing.T) {
+	const (
+		prob  = 0.01
+		total = 10000
+	)
+	sf, err := NewScalable(100, prob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < total; i++ {
+		if err := sf.Add([]byte(fmt.Sprintf("element%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sf.filters) < 5 {
+		t.Errorf("ScalableFilter has %d filters, want at least 5", len(sf.filters))
+	}
+	for i := 1; i < len(sf.filters); i++ {
+		prev, bf := sf.filters[i-1], sf.filters[i]
+		if bf.n != prev.n*2 {
+			t.Errorf("filters[%d].n = %d, want %d", i, bf.n, prev.n*2)
+		}
+		if bf.prob >= prev.prob {
+			t.Errorf("filters[%d].prob = %f, want less than %f", i, bf.prob, prev.prob)
+		}
+	}
+
+	for i := 0; i < total; i++ {
+		element := []byte(fmt.Sprintf("element%d", i))
+		if isIn, err := sf.Has(element); err != nil || !isIn {
+			t.Errorf("Has(%q) = %t, %v, want true", element, isIn, err)
+		}
+	}
+
+	var fp int
+	const queries = 10000
+	for i := 0; i < queries; i++ {
+		if isIn, _ := sf.Has([]byte(fmt.Sprintf("absent%d", i))); isIn {
+			fp++
+		}
+	}
+	if got := float64(fp) / queries; got > prob*1.5 {
+		t.Errorf("false positive rate = %f, want under %f", got, prob)
+	}
+}
+
+func TestNewScalable_error(t *testing.T) {
+	if _, err := NewScalable(0, 0.01); err != ErrZeroElements {
+		t.Errorf("NewScalable(0, 0.01) error: %q, want %q", err, ErrZeroElements)
+	}
+	if _, err := NewScalable(100, 1); err != ErrProbabilityRange {
+		t.Errorf("NewScalable(100, 1) error: %q, want %q", err, ErrProbabilityRange)
+	}
+}
+
+func TestScalableFilter_Add_duplicates(t *testing.T) {
+	sf, err := NewScalable(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Duplicates reach the capacity of insertions, but not of distinct elements.
+	for i := 0; i < 101; i++ {
+		if err = sf.Add([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The fill of one distinct element leaves room for 99 more, so the next estimate is 99 insertions later.
+	if sf.nextCheck != 199 {
+		t.Fatalf("nextCheck = %d, want 199", sf.nextCheck)
+	}
+	for i := 101; i < 199; i++ {
+		if err = sf.Add([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+		if sf.nextCheck != 199 {
+			t.Fatalf("nextCheck = %d after %d duplicates, want 199", sf.nextCheck, i+1)
+		}
+	}
+	if err = sf.Add([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if sf.nextCheck != 298 {
+		t.Errorf("nextCheck = %d, want 298", sf.nextCheck)
+	}
+	if got := sf.QueryDepth(); got != 1 {
+		t.Errorf("QueryDepth() = %d, want 1", got)
+	}
+}
+
+func TestScalableFilter_QueryDepth(t *testing.T) {
+	sf, err := NewScalable(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sf.QueryDepth(); got != 1 {
+		t.Errorf("QueryDepth() = %d, want 1", got)
+	}
+
+	prev := 1
+	for i := 0; i < 1000; i++ {
+		if err := sf.Add([]byte(fmt.Sprintf("element%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		got := sf.QueryDepth()
+		if got != len(sf.filters) {
+			t.Fatalf("QueryDepth() = %d, want %d", got, len(sf.filters))
+		}
+		if got < prev || got > prev+1 {
+			t.Fatalf("QueryDepth() = %d after %d, want it to grow by one filter at a time", got, prev)
+		}
+		prev = got
+	}
+	if prev < 4 {
+		t.Errorf("QueryDepth() = %d, want at least 4 after growth", prev)
+	}
+}
+
+func TestScalableFilter_Compact(t *testing.T) {
+	sf, err := NewScalable(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = []byte(fmt.Sprintf("element%d", i))
+		if err := sf.Add(elements[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sf.QueryDepth() == 1 {
+		t.Fatalf("QueryDepth() = 1, want more before compaction")
+	}
+
+	bf, err := sf.Compact(elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sf.QueryDepth(); got != 1 {
+		t.Errorf("QueryDepth() = %d, want 1", got)
+	}
+	if bf.n < 1000 {
+		t.Errorf("Compact() n = %d, want at least 1000", bf.n)
+	}
+	for _, e := range elements {
+		if !bf.MustHave(e) {
+			t.Errorf("compacted Has(%q) is false, want true", e)
+		}
+		if isIn, err := sf.Has(e); err != nil || !isIn {
+			t.Errorf("Has(%q) = %t, %v, want true", e, isIn, err)
+		}
+	}
+
+	// The compacted filter keeps growing.
+	for i := 0; i < 5000; i++ {
+		if err = sf.Add([]byte(fmt.Sprintf("more%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sf.QueryDepth(); got < 2 {
+		t.Errorf("QueryDepth() = %d after compaction and growth, want at least 2", got)
+	}
+}
@@ -0,0 +1,87 @@
+package bloom
+
+// maxGenerations is how many generations a TimedFilter can tell apart with its one byte stamps.
+const maxGenerations = 255
+
+// TimedFilter is a Bloom filter which approximates time-windowed membership.
+// Alongside each bit it stores a generation stamp: Add stamps the element's bits with the current generation,
+// and Rotate starts a new generation. Note, a stamp takes one byte per bit,
+// so a TimedFilter needs 9 times the memory of a Filter with the same parameters.
+// Operations are not concurrency safe.
+type TimedFilter struct {
+	filter *Filter
+	// stamps is a generation (modulo 256) of each bit when it was set last time.
+	stamps []byte
+	// generation is the current generation modulo 256.
+	generation byte
+}
+
+// NewTimed creates a new time-windowed Bloom filter for n elements
+// based on tolerated error rate of false positives.
+func NewTimed(n uint64, prob float64) (*TimedFilter, error) {
+	bf, err := New(n, prob)
+	if err != nil {
+		return nil, err
+	}
+	// A stamp takes a byte per bit.
+	if bf.bitlen > maxBuckets*8 {
+		return nil, ErrTooManyElements
+	}
+	tf := TimedFilter{
+		filter: bf,
+		stamps: make([]byte, bf.bitlen),
+	}
+	return &tf, nil
+}
+
+// Add adds an element to the set stamping its bits with the current generation.
+func (tf *TimedFilter) Add(element []byte) error {
+	pos, err := tf.filter.positions(element, tf.filter.hashqty)
+	if err != nil {
+		return err
+	}
+	tf.filter.AddPositions([][]uint64{pos})
+	for _, p := range pos {
+		tf.stamps[p] = tf.generation
+	}
+	return nil
+}
+
+// Has tests if the element is in the set regardless of when it was added.
+func (tf *TimedFilter) Has(element []byte) (bool, error) {
+	return tf.filter.Has(element)
+}
+
+// HasRecent tests if the element was added within the last withinGenerations generations,
+// i.e., all its bits were stamped since then. When withinGenerations is 1, only the current generation is considered.
+func (tf *TimedFilter) HasRecent(element []byte, withinGenerations int) (bool, error) {
+	pos, err := tf.filter.positions(element, tf.filter.hashqty)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range pos {
+		index, offset := bitlocation(p, 64)
+		if tf.filter.bitstore[index]&(1<<offset) == 0 {
+			return false, nil
+		}
+		if age := tf.generation - tf.stamps[p]; int(age) >= withinGenerations {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Rotate starts a new generation. Stamps are one byte, so bits that weren't stamped
+// for the last 255 generations are cleared to keep their age unambiguous.
+// Note, it takes linear time in the number of bits.
+func (tf *TimedFilter) Rotate() {
+	tf.generation++
+	for p, stamp := range tf.stamps {
+		if tf.generation-stamp != maxGenerations {
+			continue
+		}
+		index, offset := bitlocation(uint64(p), 64)
+		tf.filter.bitstore[index] &^= 1 << offset
+	}
+}
@@ -0,0 +1,75 @@
+package bloom
+
+import "testing"
+
+func TestTimedFilter_HasRecent(t *testing.T) {
+	tf, err := NewTimed(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := []byte("old")
+	recent := []byte("recent")
+	if err = tf.Add(old); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tf.Rotate()
+	}
+	if err = tf.Add(recent); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		element []byte
+		within  int
+		want    bool
+	}{
+		{old, 1, false},
+		{old, 3, false},
+		{old, 4, true},
+		{recent, 1, true},
+		{recent, 0, false},
+		{[]byte("absent"), 255, false},
+	}
+
+	for _, tc := range tt {
+		got, err := tf.HasRecent(tc.element, tc.within)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("HasRecent(%q, %d) is %t, want %t", tc.element, tc.within, got, tc.want)
+		}
+	}
+
+	isIn, err := tf.Has(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isIn {
+		t.Errorf("Has(%q) is false, want true", old)
+	}
+}
+
+func TestTimedFilter_Rotate(t *testing.T) {
+	tf, err := NewTimed(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	element := []byte("old")
+	if err = tf.Add(element); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxGenerations-1; i++ {
+		tf.Rotate()
+	}
+	if got, _ := tf.HasRecent(element, maxGenerations); !got {
+		t.Errorf("HasRecent(%q, %d) after %d rotations is false, want true", element, maxGenerations, maxGenerations-1)
+	}
+
+	tf.Rotate()
+	if got, _ := tf.Has(element); got {
+		t.Errorf("Has(%q) after %d rotations is true, want false", element, maxGenerations)
+	}
+}
@@ -0,0 +1,174 @@
+package bloom
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// Merge ORs the other filter into bf, so bf reports every element that was added to either filter,
+// e.g., to combine partial filters built by parallel workers.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned
+// since merging mismatched filters would corrupt membership answers.
+func (bf *Filter) Merge(other *Filter) error {
+	if !bf.compatible(other) {
+		return ErrIncompatible
+	}
+	for i, b := range other.bitstore {
+		bf.bitstore[i] |= b
+	}
+	bf.count += other.count
+	if other.maxElementLen > bf.maxElementLen {
+		bf.maxElementLen = other.maxElementLen
+	}
+	return nil
+}
+
+// ParallelUnion returns a new filter which is a union of the filters, the operands aren't modified.
+// The bitstore is split into workers subranges of buckets, and each worker ORs its subrange of all the filters.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+func ParallelUnion(workers int, filters ...*Filter) (*Filter, error) {
+	if len(filters) == 0 {
+		return nil, ErrNoFilters
+	}
+	first := filters[0]
+	for _, bf := range filters[1:] {
+		if !first.compatible(bf) {
+			return nil, ErrIncompatible
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	union := *first
+	union.bitstore = make([]uint64, len(first.bitstore))
+	union.count = 0
+	for _, bf := range filters {
+		union.count += bf.count
+		if bf.maxElementLen > union.maxElementLen {
+			union.maxElementLen = bf.maxElementLen
+		}
+	}
+
+	size := len(union.bitstore) / workers
+	if len(union.bitstore)%workers != 0 {
+		size++
+	}
+	var wg sync.WaitGroup
+	for start := 0; start < len(union.bitstore); start += size {
+		end := start + size
+		if end > len(union.bitstore) {
+			end = len(union.bitstore)
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			dst := union.bitstore[start:end]
+			for _, bf := range filters {
+				for i, b := range bf.bitstore[start:end] {
+					dst[i] |= b
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return &union, nil
+}
+
+// MergeRescale ORs the sources of different sizes into the target.
+// A source must have the same hashqty and prob as the target, and its bitlen must be a multiple of the target's bitlen.
+// Such a source is folded into the target's geometry (see Fold) before it's merged.
+// The opposite direction isn't possible: a smaller filter lost the bits which would tell
+// where its positions belong in a larger bit array.
+// ErrIncompatible is returned if any source doesn't meet the requirements or the target has no bits,
+// and the target is left unmodified then.
+func MergeRescale(target *Filter, sources ...*Filter) error {
+	if target.bitlen == 0 {
+		return ErrIncompatible
+	}
+	for _, bf := range sources {
+		if bf.hashqty != target.hashqty || bf.prob != target.prob || bf.derivation != target.derivation ||
+			bf.reduceModulo != target.reduceModulo || bf.bitlen%target.bitlen != 0 {
+			return ErrIncompatible
+		}
+	}
+
+	for _, bf := range sources {
+		bf.eachSetBit(func(p uint64) {
+			index, offset := bitlocation(bf.rescale(p, target.bitlen), 64)
+			target.bitstore[index] |= 1 << offset
+		})
+		target.count += bf.count
+	}
+	return nil
+}
+
+// UnionWithFPR ORs the other filter into bf and reports the false positive rate estimated
+// from bf's fill before and after the union, e.g., to tell when too many shards were combined.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+func (bf *Filter) UnionWithFPR(other *Filter) (beforeFPR, afterFPR float64, err error) {
+	beforeFPR = bf.CurrentFalsePositiveRate()
+	if err = bf.Merge(other); err != nil {
+		return 0, 0, err
+	}
+	return beforeFPR, bf.CurrentFalsePositiveRate(), nil
+}
+
+// BitIoU returns the bit-level Jaccard similarity of two filters: popcount(a & b) / popcount(a | b).
+// It's a cheap single pass similarity metric, e.g., to cluster filters,
+// and it's not the same as the Jaccard similarity of the underlying sets.
+// Two empty filters have zero similarity. Bits of the last bucket beyond bitlen are not counted.
+// The filters must have the same bitlen, hashqty, and n, otherwise ErrIncompatible is returned.
+func BitIoU(a, b *Filter) (float64, error) {
+	if !a.compatible(b) {
+		return 0, ErrIncompatible
+	}
+	var intersection, union int
+	for i := range a.bitstore {
+		mask := a.bucketMask(i)
+		intersection += bits.OnesCount64(a.bitstore[i] & b.bitstore[i] & mask)
+		union += bits.OnesCount64((a.bitstore[i] | b.bitstore[i]) & mask)
+	}
+	if union == 0 {
+		return 0, nil
+	}
+	return float64(intersection) / float64(union), nil
+}
+
+// Signature returns a locality-sensitive hash of the filter's set bits, so similar filters yield similar signatures,
+// e.g., to find near-duplicates in a corpus of filters before confirming them with BitIoU.
+// It's a 1-bit minwise hashing: the i-th bit of the signature is the lowest bit of the minimum of the i-th hash function
+// over all set positions. Two bits agree with probability (1 + J) / 2 where J is BitIoU of the filters,
+// so the expected Hamming distance between signatures is width * (1 - J) / 2.
+// The width in bits is capped at 64, and an empty filter has zero signature.
+// Signatures are only comparable between compatible filters.
+func (bf *Filter) Signature(width int) uint64 {
+	width = min(max(width, 0), 64)
+	seeds := make([]uint64, width)
+	mins := make([]uint64, width)
+	for i := range seeds {
+		seeds[i] = splitmix64(uint64(i) ^ sampleSeed)
+		mins[i] = math.MaxUint64
+	}
+
+	var empty = true
+	bf.eachSetBit(func(p uint64) {
+		empty = false
+		for i, seed := range seeds {
+			if h := splitmix64(p ^ seed); h < mins[i] {
+				mins[i] = h
+			}
+		}
+	})
+	if empty {
+		return 0
+	}
+
+	var sig uint64
+	for i, m := range mins {
+		sig |= (m & 1) << i
+	}
+	return sig
+}
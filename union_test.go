@@ -0,0 +1,310 @@
+package bloom
+
+import (
+	"fmt"
+	"math/bits"
+	"testing"
+)
+
+func TestFilter_Merge(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		a.MustAdd([]byte(fmt.Sprintf("a%d", i)))
+		b.MustAdd([]byte(fmt.Sprintf("b%d", i)))
+	}
+
+	if err = a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		for _, element := range []string{fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)} {
+			if !a.MustHave([]byte(element)) {
+				t.Errorf("Merge() Has(%q) is false, want true", element)
+			}
+		}
+	}
+	if a.count != 1000 {
+		t.Errorf("Merge() count = %d, want 1000", a.count)
+	}
+}
+
+func TestFilter_Merge_error(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name  string
+		other *Filter
+	}{
+		{"bitlen", &Filter{n: a.n, hashqty: a.hashqty, bitlen: a.bitlen + 1}},
+		{"hashqty", &Filter{n: a.n, hashqty: a.hashqty + 1, bitlen: a.bitlen}},
+		{"n", &Filter{n: a.n + 1, hashqty: a.hashqty, bitlen: a.bitlen}},
+	}
+
+	for _, tc := range tt {
+		if err = a.Merge(tc.other); err != ErrIncompatible {
+			t.Errorf("Merge(%s) error: %q, want %q", tc.name, err, ErrIncompatible)
+		}
+	}
+}
+
+// serialUnion merges the filters one by one into a new filter.
+func serialUnion(filters ...*Filter) *Filter {
+	union := filters[0].Clone()
+	for _, bf := range filters[1:] {
+		if err := union.Merge(bf); err != nil {
+			panic(err)
+		}
+	}
+	return union
+}
+
+func TestParallelUnion(t *testing.T) {
+	filters := make([]*Filter, 10)
+	for i := range filters {
+		bf, err := New(1000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			bf.MustAdd([]byte(fmt.Sprintf("filter%d element%d", i, j)))
+		}
+		filters[i] = bf
+	}
+	want := serialUnion(filters...)
+
+	for _, workers := range []int{0, 1, 3, 8, 1000} {
+		got, err := ParallelUnion(workers, filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(got.bitstore, want.bitstore) {
+			t.Errorf("ParallelUnion(%d) bitstore differs from serial union", workers)
+		}
+		if got.count != 1000 {
+			t.Errorf("ParallelUnion(%d) count = %d, want 1000", workers, got.count)
+		}
+	}
+}
+
+func TestParallelUnion_error(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ParallelUnion(4); err != ErrNoFilters {
+		t.Errorf("ParallelUnion() error: %q, want %q", err, ErrNoFilters)
+	}
+	if _, err = ParallelUnion(4, a, b); err != ErrIncompatible {
+		t.Errorf("ParallelUnion() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestMergeRescale(t *testing.T) {
+	target, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitlen := 2 * target.bitlen
+	source := &Filter{
+		prob:     target.prob,
+		hashqty:  target.hashqty,
+		n:        2000,
+		bitlen:   bitlen,
+		bitstore: make([]uint64, bucketqty(bitlen)),
+	}
+	for i := 0; i < 500; i++ {
+		target.MustAdd([]byte(fmt.Sprintf("target%d", i)))
+		source.MustAdd([]byte(fmt.Sprintf("source%d", i)))
+	}
+
+	if err = MergeRescale(target, source); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		for _, element := range []string{fmt.Sprintf("target%d", i), fmt.Sprintf("source%d", i)} {
+			if !target.MustHave([]byte(element)) {
+				t.Errorf("MergeRescale() Has(%q) is false, want true", element)
+			}
+		}
+	}
+}
+
+func TestMergeRescale_error(t *testing.T) {
+	target, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smaller, err := New(500, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name   string
+		source *Filter
+	}{
+		{"smaller", smaller},
+		{"ratio", &Filter{prob: target.prob, hashqty: target.hashqty, bitlen: 3*target.bitlen + 1}},
+		{"hashqty", &Filter{prob: target.prob, hashqty: 3, bitlen: 2 * target.bitlen}},
+		{"prob", &Filter{prob: 0.1, hashqty: target.hashqty, bitlen: 2 * target.bitlen}},
+	}
+
+	for _, tc := range tt {
+		if err = MergeRescale(target, tc.source); err != ErrIncompatible {
+			t.Errorf("MergeRescale(%s) error: %q, want %q", tc.name, err, ErrIncompatible)
+		}
+	}
+
+	if err = MergeRescale(&Filter{prob: target.prob, hashqty: target.hashqty}, target); err != ErrIncompatible {
+		t.Errorf("MergeRescale(zero target) error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestFilter_UnionWithFPR(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		a.MustAdd([]byte(fmt.Sprintf("a%d", i)))
+		b.MustAdd([]byte(fmt.Sprintf("b%d", i)))
+	}
+
+	before, after, err := a.UnionWithFPR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before <= 0 || after <= before {
+		t.Errorf("UnionWithFPR() = %f, %f, want afterFPR > beforeFPR > 0", before, after)
+	}
+	for i := 0; i < 500; i++ {
+		element := []byte(fmt.Sprintf("b%d", i))
+		if !a.MustHave(element) {
+			t.Errorf("UnionWithFPR() Has(%q) is false, want true", element)
+		}
+	}
+
+	c, err := New(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = a.UnionWithFPR(c); err != ErrIncompatible {
+		t.Errorf("UnionWithFPR() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestBitIoU(t *testing.T) {
+	newFilter := func(from, to int) *Filter {
+		bf, err := New(1000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i < to; i++ {
+			bf.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		}
+		return bf
+	}
+	a := newFilter(0, 500)
+
+	tt := []struct {
+		name    string
+		a, b    *Filter
+		wantMin float64
+		wantMax float64
+	}{
+		{"identical", a, a.Clone(), 1, 1},
+		// Unrelated elements share bits as well, so even disjoint sets look similar to an extent.
+		{"overlapping", a, newFilter(250, 750), 0.4, 0.55},
+		{"disjoint", a, newFilter(500, 1000), 0.1, 0.25},
+		{"empty", newFilter(0, 0), newFilter(0, 0), 0, 0},
+		// Bits beyond bitlen=48 are not counted.
+		{
+			"trailing bits",
+			&Filter{hashqty: 4, bitlen: 48, n: 1, bitstore: []uint64{0xffff00000000000f}},
+			&Filter{hashqty: 4, bitlen: 48, n: 1, bitstore: []uint64{0xffff0000000000f0}},
+			0, 0,
+		},
+	}
+
+	for _, tc := range tt {
+		got, err := BitIoU(tc.a, tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got < tc.wantMin || got > tc.wantMax {
+			t.Errorf("BitIoU(%s) = %f, want in [%f, %f]", tc.name, got, tc.wantMin, tc.wantMax)
+		}
+	}
+
+	if _, err := BitIoU(a, &Filter{bitlen: 10}); err != ErrIncompatible {
+		t.Errorf("BitIoU() error: %q, want %q", err, ErrIncompatible)
+	}
+}
+
+func TestFilter_Signature(t *testing.T) {
+	a, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		a.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		b.MustAdd([]byte(fmt.Sprintf("element%d", i)))
+		c.MustAdd([]byte(fmt.Sprintf("other%d", i)))
+	}
+	for i := 0; i < 20; i++ {
+		b.MustAdd([]byte(fmt.Sprintf("extra%d", i)))
+	}
+
+	if got := bits.OnesCount64(a.Signature(64) ^ b.Signature(64)); got > 6 {
+		t.Errorf("Hamming distance of overlapping filters = %d, want at most 6", got)
+	}
+	if got := bits.OnesCount64(a.Signature(64) ^ c.Signature(64)); got < 10 {
+		t.Errorf("Hamming distance of disjoint filters = %d, want at least 10", got)
+	}
+	if got := a.Signature(16); got>>16 != 0 {
+		t.Errorf("Signature(16) = %x, want 16 bits", got)
+	}
+
+	empty, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := empty.Signature(64); got != 0 {
+		t.Errorf("Signature(64) of empty filter = %x, want 0", got)
+	}
+
+	// Bits beyond bitlen=48 don't affect the signature.
+	trailing := &Filter{hashqty: 4, bitlen: 48, n: 1, bitstore: []uint64{0xffff000000000000}}
+	if got := trailing.Signature(64); got != 0 {
+		t.Errorf("Signature(64) of filter with trailing bits = %x, want 0", got)
+	}
+	trailing.bitstore[0] |= 0xf
+	if got, want := trailing.Signature(64), (&Filter{hashqty: 4, bitlen: 48, n: 1, bitstore: []uint64{0xf}}).Signature(64); got != want {
+		t.Errorf("Signature(64) of filter with trailing bits = %x, want %x", got, want)
+	}
+}